@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ips and cidrs that are never banned (fail2ban's ignoreip).
+// Offending ips within are still counted but attempted bans are only logged.
+type Allowlist struct {
+	path      string      // Optional file of ips/cidrs, one per line
+	cidrs     []string    // From the command line
+
+	mux       sync.Mutex
+	static    []*net.IPNet
+	temporary map[string]TemporaryAllow // Api managed entries by cidr
+}
+
+type TemporaryAllow struct {
+	IpNet  *net.IPNet
+	Expiry time.Time
+	Reason string
+}
+
+// Single address cidr, eg 192.0.2.1/32
+func SingleCidr(ip net.IP) *net.IPNet {
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 8 * net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+func IsSingleCidr(ipnet *net.IPNet) bool {
+	ones, bits := ipnet.Mask.Size()
+	return ones == bits
+}
+
+// The ip alone if a single address cidr, as displayed and keyed by (eg the pending bans)
+func CidrString(ipnet *net.IPNet) string {
+	if IsSingleCidr(ipnet) {
+		return ipnet.IP.String()
+	}
+	return ipnet.String()
+}
+
+// Parse an ip or cidr, ips are treated as single address cidrs
+func ParseCidr(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("%q is not a valid ip or cidr", s)
+		}
+		return SingleCidr(ip), nil
+	}
+
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a valid ip or cidr", s)
+	}
+	return ipnet, nil
+}
+
+// Parse comma separated ips/cidrs
+func ParseCidrs(s string) ([]*net.IPNet, error) {
+	ipnets := []*net.IPNet{}
+	if s == "" {
+		return ipnets, nil
+	}
+
+	for _, t := range strings.Split(s, ",") {
+		ipnet, err := ParseCidr(strings.TrimSpace(t))
+		if err != nil {
+			return nil, err
+		}
+		ipnets = append(ipnets, ipnet)
+	}
+	return ipnets, nil
+}
+
+func NewAllowlist(cidrs []string, path string) (*Allowlist, error) {
+	allowlist := &Allowlist{
+		     path: path,
+		    cidrs: cidrs,
+		temporary: make(map[string]TemporaryAllow),
+	}
+
+	if err := allowlist.Reload(); err != nil {
+		return nil, err
+	}
+
+	return allowlist, nil
+}
+
+// (Re)load the command line and file entries, temporary entries are unaffected
+func (a *Allowlist) Reload() error {
+	entries := append([]string{}, a.cidrs...)
+
+	if a.path != "" {
+		file, err := os.Open(a.path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if i := strings.Index(line, "#"); i != -1 {
+				line = line[:i]
+			}
+			if line = strings.TrimSpace(line); line != "" {
+				entries = append(entries, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	static := []*net.IPNet{}
+	for _, entry := range entries {
+		ipnet, err := ParseCidr(entry)
+		if err != nil {
+			return err
+		}
+		static = append(static, ipnet)
+	}
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	a.static = static
+	InfoLog("allowlist: %d entries loaded", len(static))
+
+	return nil
+}
+
+func (a *Allowlist) Contains(ip net.IP) bool {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	for _, ipnet := range a.static {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	now := time.Now()
+	for s, entry := range a.temporary {
+		if !entry.Expiry.IsZero() && now.After(entry.Expiry) {
+			delete(a.temporary, s)
+			continue
+		}
+		if entry.IpNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Whether any entry overlaps ipnet, ie whether banning ipnet would ban an allowlisted ip
+func (a *Allowlist) Overlaps(ipnet *net.IPNet) bool {
+	overlap := func(entry *net.IPNet) bool {
+		return entry.Contains(ipnet.IP) || ipnet.Contains(entry.IP)
+	}
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	for _, entry := range a.static {
+		if overlap(entry) {
+			return true
+		}
+	}
+
+	now := time.Now()
+	for _, entry := range a.temporary {
+		if (entry.Expiry.IsZero() || now.Before(entry.Expiry)) && overlap(entry.IpNet) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// A zero expiry never expires
+func (a *Allowlist) AddTemporary(ipnet *net.IPNet, expiry time.Time, reason string) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	a.temporary[ipnet.String()] = TemporaryAllow{IpNet: ipnet, Expiry: expiry, Reason: reason}
+}
+
+func (a *Allowlist) DelTemporary(ipnet *net.IPNet) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	delete(a.temporary, ipnet.String())
+}
+
+// Replace all temporary entries, eg with those shared via redis
+func (a *Allowlist) SetTemporary(entries []TemporaryAllow) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	a.temporary = make(map[string]TemporaryAllow)
+	for _, entry := range entries {
+		a.temporary[entry.IpNet.String()] = entry
+	}
+}
+
+func (a *Allowlist) WriteState(w *http.ResponseWriter) error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	table := make(map[string]string)
+	for _, ipnet := range a.static {
+		table[ipnet.String()] = "static"
+	}
+
+	now := time.Now()
+	for s, entry := range a.temporary {
+		if !entry.Expiry.IsZero() && now.After(entry.Expiry) {
+			continue
+		}
+
+		pretty := "temporary"
+		if !entry.Expiry.IsZero() {
+			pretty += entry.Expiry.Format(" (until 2006-01-02T15:04:05)")
+		}
+		if entry.Reason != "" {
+			pretty += " " + html.EscapeString(entry.Reason)
+		}
+		table[s] = pretty
+	}
+
+	return WriteTable(w, table)
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"net"
 	"os/exec"
-	"strings"
 	"sync"
 	"time"
 )
@@ -52,7 +51,20 @@ func NewIpSet(name string) (*IpSet, error) {
 	return &IpSet{ Name: name, Id: id }, nil
 }
 
-func (i *IpSet) Get() ([]net.IP, string, error) {
+// Ip sets in the given order, eg of the escalation tiers
+func NewIpSets(names []string) ([]*IpSet, error) {
+	ipsets := []*IpSet{}
+	for _, name := range names {
+		ipset, err := NewIpSet(name)
+		if err != nil {
+			return nil, err
+		}
+		ipsets = append(ipsets, ipset)
+	}
+	return ipsets, nil
+}
+
+func (i *IpSet) Get() ([]*net.IPNet, string, error) {
 	cmd := []string{"aws", "wafv2", "get-ip-set",
 	                "--name", i.Name, "--scope", "REGIONAL", "--id", i.Id}
 
@@ -76,48 +88,38 @@ func (i *IpSet) Get() ([]net.IP, string, error) {
 		return nil, "", err
 	}
 
-	ips := []net.IP{}
+	ipnets := []*net.IPNet{}
 	for _, addr := range parsed.IpSet.Addrs {
-		t := strings.Split(addr, "/")
-		if len(t) != 2 {
-			WarningLog("unexpected address format %s", addr)
-			continue
-		}
-		if t[1] != "32" {
-			WarningLog("non address cidr %s", addr)
-			continue
-		}
-
-		ip := net.ParseIP(t[0])
-		if ip == nil {
+		_, ipnet, err := net.ParseCIDR(addr)
+		if err != nil {
 			WarningLog("invalid address %s", addr)
 			continue
 		}
-		ips = append(ips, ip)
+		ipnets = append(ipnets, ipnet)
 	}
 
-	return ips, parsed.LockToken, nil
+	return ipnets, parsed.LockToken, nil
 }
 
 // TODO Rather than adding/deleting one at a time using a queuing system and batch the operations?
 
-func (i *IpSet) Add(ip net.IP) error {
+func (i *IpSet) Add(ipnet *net.IPNet) error {
 	i.mux.Lock()
 	defer i.mux.Unlock()
 
 	limit := 3
 	for n := 0; n < limit; n++ {
-		ips, token, err := i.Get()
+		ipnets, token, err := i.Get()
 		if err != nil {
 			return err
 		}
 
-		if len(ips) == 10000 {
+		if len(ipnets) == 10000 {
 			return fmt.Errorf("ipset at maximum capacity")
 		}
 
-		for _, i := range ips {
-			if i.Equal(ip) {
+		for _, i := range ipnets {
+			if i.String() == ipnet.String() {
 				return nil
 			}
 		}
@@ -126,13 +128,13 @@ func (i *IpSet) Add(ip net.IP) error {
 				"--name", i.Name, "--scope", "REGIONAL", "--id", i.Id,
 				"--lock-token", token, "--addresses"}
 
-		for _, i := range ips {
-			cmd = append(cmd, i.String() + "/32")
+		for _, i := range ipnets {
+			cmd = append(cmd, i.String())
 		}
-		cmd = append(cmd, ip.String() + "/32")
+		cmd = append(cmd, ipnet.String())
 
 		if err := exec.Command(cmd[0], cmd[1:]...).Run(); err != nil {
-			WarningLog("failed to update ipset to add %s attempt %d", ip.String(), n+1)
+			WarningLog("failed to update ipset to add %s attempt %d", ipnet.String(), n+1)
 			if n < limit-1 {
 				time.Sleep(time.Duration((n+1) * 5) * time.Second)
 			}
@@ -141,23 +143,23 @@ func (i *IpSet) Add(ip net.IP) error {
 		}
 	}
 
-	return fmt.Errorf("lock contention attempting to add %s", ip.String())
+	return fmt.Errorf("lock contention attempting to add %s", ipnet.String())
 }
 
-func (i *IpSet) Del(ip net.IP) error {
+func (i *IpSet) Del(ipnet *net.IPNet) error {
 	i.mux.Lock()
 	defer i.mux.Unlock()
 
 	limit := 3
 	for n := 0; n < limit; n++ {
-		ips, token, err := i.Get()
+		ipnets, token, err := i.Get()
 		if err != nil {
 			return err
 		}
 
 		found := false
-		for _, i := range ips {
-			if i.Equal(ip) {
+		for _, i := range ipnets {
+			if i.String() == ipnet.String() {
 				found = true
 				break
 			}
@@ -170,15 +172,15 @@ func (i *IpSet) Del(ip net.IP) error {
 				"--name", i.Name, "--scope", "REGIONAL", "--id", i.Id,
 				"--lock-token", token, "--addresses"}
 
-		for _, i := range ips {
-			if i.Equal(ip) {
+		for _, i := range ipnets {
+			if i.String() == ipnet.String() {
 				continue
 			}
-			cmd = append(cmd, i.String() + "/32")
+			cmd = append(cmd, i.String())
 		}
 
 		if err := exec.Command(cmd[0], cmd[1:]...).Run(); err != nil {
-			WarningLog("failed to update ipset to delete %s attempt %d", ip.String(), n+1)
+			WarningLog("failed to update ipset to delete %s attempt %d", ipnet.String(), n+1)
 			if n < limit-1 {
 				time.Sleep(time.Duration((n+1) * 5) * time.Second)
 			}
@@ -187,5 +189,5 @@ func (i *IpSet) Del(ip net.IP) error {
 		}
 	}
 
-	return fmt.Errorf("lock contention attempting to delete %s", ip.String())
+	return fmt.Errorf("lock contention attempting to delete %s", ipnet.String())
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Local cache of the ips this process knows to be banned (count model only, see Jail.cacheable), used in service mode
+// so that the infractions reported while an ip is banned (eg during WAF propagation) cost no redis round trip.
+// Such infractions are coalesced and only the latest recorded every cacheFlushPeriod, which extends the ban exactly
+// as recording each would have as a ban ends BanTime after the latest infraction. Infractions are only coalesced
+// while the recorded ban has over two flush periods left so that it cannot be lifted before the extension is recorded.
+// Entries are invalidated by the unban events of every process, see consume.
+const cacheFlushPeriod = 5 * time.Second
+
+type BanCache struct {
+	mux     sync.Mutex
+	entries map[string]*cachedBan
+}
+
+type cachedBan struct {
+	ip       net.IP
+	until    time.Time // As recorded
+	latest   time.Time // Of the coalesced infractions, zero if none
+	reporter string    // Of the latest
+	pending  int
+}
+
+func NewBanCache() *BanCache {
+	return &BanCache{entries: make(map[string]*cachedBan)}
+}
+
+// Record that ip is banned until then, keeping any infractions coalesced in the meantime
+func (c *BanCache) Set(ip net.IP, until time.Time) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	entry, ok := c.entries[ip.String()]
+	if !ok {
+		entry = &cachedBan{ip: ip}
+		c.entries[ip.String()] = entry
+	}
+	entry.until = until
+}
+
+// Coalesce an infraction of ip at t, false if it must instead be recorded
+func (c *BanCache) Absorb(ip net.IP, reporter string, t time.Time) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	entry, ok := c.entries[ip.String()]
+	if !ok || entry.until.Sub(t) <= 2 * cacheFlushPeriod {
+		return false
+	}
+
+	entry.latest = t
+	entry.reporter = reporter
+	entry.pending++
+	return true
+}
+
+// Drop the entries within ipnet, along with their coalesced infractions
+func (c *BanCache) Invalidate(ipnet *net.IPNet) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	for s, entry := range c.entries {
+		if ipnet.Contains(entry.ip) {
+			delete(c.entries, s)
+		}
+	}
+}
+
+// The entries with coalesced infractions to be recorded, resetting them and dropping those whose ban has ended
+func (c *BanCache) Take(now time.Time) []cachedBan {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	taken := []cachedBan{}
+	for s, entry := range c.entries {
+		if entry.pending > 0 {
+			taken = append(taken, *entry)
+			entry.latest = time.Time{}
+			entry.pending = 0
+		} else if !entry.until.After(now) {
+			delete(c.entries, s)
+		}
+	}
+	return taken
+}
+
+// Whether the infractions of ips banned under policy may be coalesced, ie only their latest matters
+func (j *Jail) cacheable(policy Policy, learning bool) bool {
+	return j.cache != nil && j.model == CountModel && len(j.backends) == 1 && len(j.subnets) == 0 &&
+	       policy.Quorum <= 1 && !policy.AlertOnly && !learning
+}
+
+// Record the latest of the infractions coalesced, as reported
+func (j *Jail) flushCache() {
+	if j.cache == nil {
+		return
+	}
+
+	for _, entry := range j.cache.Take(j.now()) {
+		DebugLog("%s: recording the latest of %d coalesced infractions", entry.ip.String(), entry.pending)
+		err := j.addInfraction(entry.ip, entry.reporter, false, entry.latest)
+		if err != nil && j.degraded != nil && j.degraded.store.Unavailable(err) {
+			j.degraded.add(entry.ip, entry.reporter, entry.latest, err)
+		} else if err != nil {
+			ErrorLog(err.Error())
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Ban rate limits are counted under these store keys, the jail's suffixed with its ip set name (see Jail.rateKey)
+// so that only the global one is shared by every jail of the namespace in service mode
+const (
+	jailRateKey = "jail"
+	globalRateKey = "global"
+)
+
+// At most Bans automatic bans within Window seconds, zero for unlimited
+type BanRate struct {
+	Bans   int
+	Window int // In seconds
+}
+
+// Parse a rate of the form <bans>/<secs>, eg 100/60, empty for unlimited
+func ParseBanRate(s string) (BanRate, error) {
+	if s == "" {
+		return BanRate{}, nil
+	}
+
+	t := strings.SplitN(s, "/", 2)
+	if len(t) != 2 {
+		return BanRate{}, fmt.Errorf("%q is not a valid ban rate", s)
+	}
+
+	bans, err := strconv.Atoi(t[0])
+	if err != nil || bans <= 0 {
+		return BanRate{}, fmt.Errorf("%q is not a valid ban rate", s)
+	}
+	window, err := strconv.Atoi(t[1])
+	if err != nil || window <= 0 {
+		return BanRate{}, fmt.Errorf("%q is not a valid ban rate", s)
+	}
+
+	return BanRate{Bans: bans, Window: window}, nil
+}
+
+func (r BanRate) String() string {
+	if r.Bans == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d bans / %ds", r.Bans, r.Window)
+}
+
+// Safety valve against runaway banning (eg a misconfigured reporter or the load balancer's own ip).
+// Once either rate is exceeded the breaker trips, the jail then only alerts and holds new bans pending until resumed.
+type Breaker struct {
+	Jail   BanRate
+	Global BanRate
+}
+
+func (b Breaker) Enabled() bool {
+	return b.Jail.Bans > 0 || b.Global.Bans > 0
+}
+
+// Of an ip or a subnet (see Subnet), held as of the latest infraction warranting it
+type PendingBan struct {
+	IpNet *net.IPNet
+	Held  time.Time
+}
+
+func WriteBreaker(w *http.ResponseWriter, breaker Breaker, tripped bool, pending []PendingBan) error {
+	table := make(map[string]string)
+
+	table["state"] = "closed"
+	if tripped {
+		table["state"] = "tripped, bans held until resumed"
+	}
+	table["jail limit"] = breaker.Jail.String()
+	table["global limit"] = breaker.Global.String()
+
+	for _, ban := range pending {
+		table[CidrString(ban.IpNet)] = ban.Held.Format("held since 2006-01-02T15:04:05")
+	}
+
+	return WriteTable(w, table)
+}
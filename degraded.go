@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Implemented by stores shared over the network which may become unavailable, see Degraded
+type SharedStore interface {
+	Ping() error
+	// Whether err is due to the store being unavailable rather than the request
+	Unavailable(err error) bool
+}
+
+const (
+	degradedBufferLimit = 10000 // Infractions, the oldest are dropped beyond
+	degradedProbePeriod = 5 * time.Second
+)
+
+// Service mode fallback while the shared store is unavailable. Infractions are buffered (bounded) and decided upon
+// by a fallback jail with a memory store, which bans but never unbans as the manual bans are unknown meanwhile.
+// Once the store is available again the buffered infractions are replayed into it (as of when they were reported)
+// and the fallback bans that the store does not also warrant are lifted.
+type Degraded struct {
+	store     SharedStore
+
+	mux       sync.Mutex
+	since     time.Time // Zero unless degraded
+	probed    time.Time
+	buffer    []bufferedInfraction
+	dropped   int
+	fallback  *Jail
+	episodes  int
+	replaying map[string]bool // Ips and cidrs banned by the fallback, whose ban hooks are not fired again by the replay
+}
+
+type bufferedInfraction struct {
+	ip       net.IP
+	reporter string
+	t        time.Time
+}
+
+// Of the degraded mode, see Jailer.Health
+type Health struct {
+	Degraded bool
+	Since    time.Time
+	Buffered int
+	Dropped  int // Since degraded
+	Episodes int // Times degraded since started
+}
+
+func NewDegraded(jail *Jail, store SharedStore) *Degraded {
+	return &Degraded{store: store, fallback: newFallback(jail)}
+}
+
+func newFallback(jail *Jail) *Jail {
+	fallback := NewJail(NewMemoryStore(), jail.backends, jail.model, jail.allowlist, jail.overrides, jail.breaker, jail.hooks)
+	fallback.name = jail.name
+	fallback.id = jail.id
+	fallback.subnets = jail.subnets
+	fallback.now = jail.now
+	fallback.simulated = jail.simulated
+	return fallback
+}
+
+func (d *Degraded) active() bool {
+	if d == nil {
+		return false
+	}
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	return !d.since.IsZero()
+}
+
+// Buffer and decide upon an infraction locally, entering degraded mode if need be (cause is nil if already degraded)
+func (d *Degraded) add(ip net.IP, reporter string, now time.Time, cause error) {
+	d.mux.Lock()
+	if d.since.IsZero() {
+		reason := "probe pending"
+		if cause != nil {
+			reason = cause.Error()
+		}
+		ErrorLog("degraded as the store is unavailable: %s", reason)
+		d.since = now
+		d.probed = now
+		d.dropped = 0
+		d.episodes++
+	}
+
+	d.buffer = append(d.buffer, bufferedInfraction{ip: ip, reporter: reporter, t: now})
+	if n := len(d.buffer) - degradedBufferLimit; n > 0 {
+		d.buffer = d.buffer[n:]
+		d.dropped += n
+	}
+	fallback := d.fallback
+	d.mux.Unlock()
+
+	if err := fallback.addInfraction(ip, reporter, false, now); err != nil {
+		ErrorLog(err.Error())
+	}
+}
+
+// Probe the store and if available again replay the buffer into jail, called periodically.
+// Infractions reported meanwhile are still buffered, hence replayed until the buffer is drained.
+func (d *Degraded) probe(jail *Jail, now time.Time) {
+	d.mux.Lock()
+	if d.since.IsZero() || now.Sub(d.probed) < degradedProbePeriod {
+		d.mux.Unlock()
+		return
+	}
+	d.probed = now
+	since, dropped := d.since, d.dropped
+	d.mux.Unlock()
+
+	if err := d.store.Ping(); err != nil {
+		DebugLog("store still unavailable: %s", err.Error())
+		return
+	}
+	InfoLog("store available again after %s, replaying the buffered infractions (%d dropped)", now.Sub(since).Round(time.Second), dropped)
+
+	d.mux.Lock()
+	fallback := d.fallback
+	d.mux.Unlock()
+	fired := fallback.fallbackBans()
+	d.mux.Lock()
+	d.replaying = fired
+	d.mux.Unlock()
+
+	replayed := 0
+	for {
+		d.mux.Lock()
+		buffer := d.buffer
+		d.buffer = nil
+		if len(buffer) == 0 {
+			break
+		}
+		d.mux.Unlock()
+
+		for i, infraction := range buffer {
+			err := jail.addInfraction(infraction.ip, infraction.reporter, false, infraction.t)
+			if err != nil && d.store.Unavailable(err) {
+				d.mux.Lock()
+				d.buffer = append(append([]bufferedInfraction{}, buffer[i:]...), d.buffer...)
+				d.mux.Unlock()
+				ErrorLog("store unavailable again after replaying %d infractions: %s", replayed, err.Error())
+				return
+			} else if err != nil {
+				ErrorLog(err.Error())
+			}
+			replayed++
+		}
+	}
+
+	// Still locked from the drained buffer
+	d.since = time.Time{}
+	d.fallback = newFallback(jail)
+	d.replaying = nil
+	d.mux.Unlock()
+
+	InfoLog("no longer degraded, %d infractions replayed", replayed)
+	jail.reconcile(fallback, now)
+}
+
+// Whether the ban hook of an ip or cidr was already fired by the fallback jail, while replaying
+func (d *Degraded) fired(ip string) bool {
+	if d == nil {
+		return false
+	}
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	return d.replaying[ip]
+}
+
+// The ips and cidrs banned by a fallback jail
+func (j *Jail) fallbackBans() map[string]bool {
+	banned := make(map[string]bool)
+
+	states, _, err := j.store.States("", 0)
+	if err != nil {
+		ErrorLog(err.Error())
+	}
+	for _, state := range states {
+		if (state.Score != nil && state.Score.Banned) || !bannedUntil(state.Infractions, j.overrides.Policy(state.Ip)).IsZero() {
+			banned[state.Ip.String()] = true
+		}
+	}
+
+	bans, err := j.store.ManualBans()
+	if err != nil {
+		ErrorLog(err.Error())
+	}
+	for _, ban := range bans {
+		banned[ban.IpNet.String()] = true
+	}
+
+	return banned
+}
+
+// Lift the bans of the fallback that the store does not also warrant
+func (j *Jail) reconcile(fallback *Jail, now time.Time) {
+	states, _, err := fallback.store.States("", 0)
+	if err != nil {
+		ErrorLog(err.Error())
+		return
+	}
+
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	for _, state := range states {
+		var endtime time.Time
+		if state.Score != nil {
+			endtime = state.Score.BannedUntil()
+		} else {
+			endtime = bannedUntil(state.Infractions, j.overrides.Policy(state.Ip))
+		}
+		if endtime.IsZero() {
+			continue
+		}
+
+		if banned, err := j.stillBanned(state.Ip, now); err != nil {
+			ErrorLog(err.Error())
+		} else if !banned {
+			InfoLog("%s fallback ban not warranted by the store", state.Ip.String())
+			j.unban(state.Ip)
+		}
+	}
+
+	// Its subnet bans, which expire with the store's manual ban of the same cidr if any
+	bans, err := fallback.store.ManualBans()
+	if err != nil {
+		ErrorLog(err.Error())
+		return
+	}
+	for _, ban := range bans {
+		if banned, err := j.manualBan(ban.IpNet); err != nil {
+			ErrorLog(err.Error())
+		} else if banned == nil {
+			InfoLog("%s fallback ban not warranted by the store", ban.IpNet.String())
+			j.unbanCidr(j.backend, ban.IpNet)
+			j.fire(HookUnban, ban.IpNet.String(), "")
+		}
+	}
+}
+
+func (j *Jail) Health() Health {
+	if j.degraded == nil {
+		return Health{}
+	}
+
+	j.degraded.mux.Lock()
+	defer j.degraded.mux.Unlock()
+
+	return Health{
+		Degraded: !j.degraded.since.IsZero(),
+		   Since: j.degraded.since,
+		Buffered: len(j.degraded.buffer),
+		 Dropped: j.degraded.dropped,
+		Episodes: j.degraded.episodes,
+	}
+}
+
+func (h Health) String() string {
+	if !h.Degraded {
+		return "ok"
+	}
+	return fmt.Sprintf("degraded since %s, %d infractions buffered (%d dropped)", h.Since.Format("2006-01-02T15:04:05"), h.Buffered, h.Dropped)
+}
+
+func WriteHealth(w *http.ResponseWriter, health Health) error {
+	table := make(map[string]string)
+
+	table["status"] = health.String()
+	table["degraded episodes"] = fmt.Sprintf("%d", health.Episodes)
+	if health.Degraded {
+		table["buffered"] = fmt.Sprintf("%d of at most %d", health.Buffered, degradedBufferLimit)
+		table["dropped"] = fmt.Sprintf("%d", health.Dropped)
+	}
+
+	return WriteTable(w, table)
+}
@@ -0,0 +1,1274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Manual bans are scheduled under a distinct key from ips
+const manualBanPrefix = "ban "
+
+const (
+	duePollPeriod = 1 * time.Second
+	dueRetryPeriod = 10 * time.Second // Of keys claimed as due whose management failed
+	allowlistSyncPeriod = 1 * time.Minute
+)
+
+// Implements the jail policy once on top of an InfractionStore so that behaviour is identical across modes
+type Jail struct {
+	name      string // Of the block ip set
+	store     InfractionStore
+	backends  []Backend // Escalation tiers, see Tier
+	backend   Backend   // The block tier, ie the last
+	model     string
+	allowlist *Allowlist
+	overrides *Overrides
+	breaker   Breaker
+	hooks     *Hooks    // Nil for none
+	cache     *BanCache // Nil for none
+	degraded  *Degraded // Nil unless the store is shared
+	subnets   []SubnetPolicy
+
+	learning   Learning
+	learnUntil time.Time // Zero if not learning
+
+	// Serializes the read-modify-write sequences on the store within this process,
+	// stores shared amongst processes are expected to tolerate interleaving
+	mux       sync.Mutex
+
+	id        string // Of this process, see leaseDuration
+	leaderMux sync.Mutex
+	leader    string
+	leased    time.Time // When the lease was last checked
+
+	subsMux   sync.Mutex
+	subs      map[chan HookEvent]bool // Event stream subscribers, see Subscribe
+
+	// Overridden when simulating, see Simulate
+	now       func() time.Time
+	simulated bool // Backend updates effected synchronously
+
+	quitChan  chan bool
+}
+
+func NewJail(store InfractionStore, backends []Backend, model string, allowlist *Allowlist, overrides *Overrides, breaker Breaker, hooks *Hooks) *Jail {
+	return &Jail{
+		    store: store,
+		 backends: backends,
+		  backend: backends[len(backends)-1],
+		    model: model,
+		allowlist: allowlist,
+		overrides: overrides,
+		  breaker: breaker,
+		    hooks: hooks,
+		       id: processId(),
+		     subs: make(map[chan HookEvent]bool),
+		      now: time.Now,
+		 quitChan: make(chan bool),
+	}
+}
+
+// Ensure ip set contents (of the given tier) are being managed
+func (j *Jail) Import(level int, ipnets []*net.IPNet) {
+	for _, ipnet := range ipnets {
+		// Presumably manually added, the reason for which is unknown
+		if !IsSingleCidr(ipnet) {
+			if level < len(j.backends) {
+				WarningLog("%s ignored as not a single ip in tier %d", ipnet.String(), level)
+			} else if ban, err := j.manualBan(ipnet); err != nil {
+				ErrorLog(err.Error())
+			} else if ban == nil {
+				if err := j.store.SetManualBan(ManualBan{IpNet: ipnet, Reason: "(imported)"}); err != nil {
+					ErrorLog(err.Error())
+				}
+			}
+			continue
+		}
+		ip := ipnet.IP
+
+		if j.manuallyBanned(ip) {
+			continue
+		}
+
+		if len(j.backends) > 1 {
+			err := j.store.UpdateTier(ip, func(tier *Tier) bool {
+				if tier.Level < level {
+					*tier = Tier{Level: level}
+				}
+				return true
+			})
+			if err != nil {
+				ErrorLog(err.Error())
+			}
+		}
+
+		if j.model == ScoreModel {
+			err := j.updateScore(ip, func(score *Score) bool {
+				score.Decay(j.now())
+				if score.Value < BanScore {
+					score.Value = BanScore
+				}
+				score.Banned = true
+				return true
+			})
+			if err != nil {
+				ErrorLog(err.Error())
+			}
+			continue
+		}
+
+		infractions, err := j.store.Infractions(ip)
+		if err != nil {
+			ErrorLog(err.Error())
+			continue
+		}
+
+		for i:=len(infractions); i<j.overrides.Policy(ip).MaxRetry; i++ {
+			if err := j.addInfraction(ip, "", true, j.now()); err != nil {
+				ErrorLog(err.Error())
+			}
+		}
+	}
+}
+
+// Periodically manage the ips (and manual bans) that are due, if the leader
+func (j *Jail) Start() {
+	go j.consume()
+
+	go func() {
+		lastSync := time.Now()
+		lastFlush := time.Now()
+		learnt := false
+
+		for {
+			select {
+				case <-j.quitChan:
+					return
+				case <-time.After(duePollPeriod):
+					// Nothing else is attempted of the store meanwhile
+					if j.degraded.active() {
+						j.degraded.probe(j, j.now())
+						continue
+					}
+
+					if time.Since(j.lastLeased()) >= leaseRenewPeriod {
+						j.lead()
+					}
+					if j.leading() {
+						j.manageDue(j.now())
+					}
+			}
+
+			if time.Since(lastSync) >= allowlistSyncPeriod {
+				if err := j.syncAllowlist(); err != nil {
+					ErrorLog(err.Error())
+				}
+				lastSync = time.Now()
+			}
+
+			if time.Since(lastFlush) >= cacheFlushPeriod {
+				j.flushCache()
+				lastFlush = time.Now()
+			}
+
+			if !learnt && !j.learnUntil.IsZero() && !j.learningAt(j.now()) {
+				j.reportLearning()
+				learnt = true
+			}
+		}
+	}()
+}
+
+func (j *Jail) Close() error {
+	close(j.quitChan)
+	j.flushCache()
+
+	if health := j.Health(); health.Buffered > 0 {
+		WarningLog("%d buffered infractions lost as the store is still unavailable", health.Buffered)
+	}
+
+	// Hand over promptly rather than once the lease expires
+	if j.leading() {
+		if err := j.store.Resign(j.id); err != nil {
+			ErrorLog(err.Error())
+		}
+	}
+
+	return j.store.Close()
+}
+
+// Claim or renew the lease, on failure this process stands by as it can no longer be sure to be the leader
+func (j *Jail) lead() {
+	leader, err := j.store.Lead(j.id, leaseDuration)
+	if err != nil {
+		ErrorLog(err.Error())
+		leader = ""
+	}
+
+	j.leaderMux.Lock()
+	defer j.leaderMux.Unlock()
+
+	if leader != j.leader {
+		if leader == j.id {
+			InfoLog("leading as %s", j.id)
+		} else if j.leader == j.id {
+			WarningLog("no longer leading, leader is %q", leader)
+		} else {
+			DebugLog("leader is %q", leader)
+		}
+	}
+	j.leader = leader
+	j.leased = time.Now()
+}
+
+func (j *Jail) leading() bool {
+	j.leaderMux.Lock()
+	defer j.leaderMux.Unlock()
+
+	return j.leader == j.id
+}
+
+func (j *Jail) lastLeased() time.Time {
+	j.leaderMux.Lock()
+	defer j.leaderMux.Unlock()
+
+	return j.leased
+}
+
+func (j *Jail) WriteLeader(w *http.ResponseWriter) error {
+	j.leaderMux.Lock()
+	defer j.leaderMux.Unlock()
+
+	return WriteLeader(w, j.id, j.leader, j.leased)
+}
+
+func (j *Jail) AddInfraction(ip net.IP, reporter string) error {
+	now := j.now()
+	if j.cache != nil && j.cache.Absorb(ip, reporter, now) {
+		return nil
+	}
+
+	if j.degraded.active() {
+		j.degraded.add(ip, reporter, now, nil)
+		return nil
+	}
+
+	err := j.addInfraction(ip, reporter, false, now)
+	if err != nil && j.degraded != nil && j.degraded.store.Unavailable(err) {
+		j.degraded.add(ip, reporter, now, err)
+		return nil
+	}
+	return err
+}
+
+// Imported ips are already banned hence bypass the circuit breaker and reporter quorum.
+// Reported at now, which is earlier for infractions coalesced by the cache.
+func (j *Jail) addInfraction(ip net.IP, reporter string, imported bool, now time.Time) error {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	if j.learningAt(now) && !imported {
+		if err := j.store.RecordLearning(ip, now); err != nil {
+			return err
+		}
+	}
+
+	if !imported {
+		j.publish(HookEvent{Event: EventInfraction, Ip: ip.String(), Time: now, Jail: j.name, Reason: "reported by " + reporter, Origin: j.id})
+	}
+
+	policy := j.overrides.Policy(ip)
+
+	reporters := 0
+	if policy.Quorum > 1 && !imported {
+		distinct, err := j.store.AddReport(ip.String(), reporter, now, time.Duration(policy.FindTime) * time.Second)
+		if err != nil {
+			return err
+		}
+		DebugLog("reporters[%s] = %s", ip.String(), strings.Join(distinct, ","))
+		reporters = len(distinct)
+	}
+	quorate := policy.Quorum <= 1 || imported || reporters >= policy.Quorum
+
+	if !imported && !policy.AlertOnly {
+		if err := j.countSubnets(ip, reporter, policy, now); err != nil {
+			return err
+		}
+	}
+
+	if j.model == ScoreModel {
+		return j.addScore(ip, now, quorate)
+	}
+
+	// Retain infractions long enough for both finding and banning
+	ttl := policy.BanTime
+	if policy.FindTime > ttl {
+		ttl = policy.FindTime
+	}
+
+	// Known before recording so that the store can retain the infractions accordingly in the same atomic step,
+	// the local copy of the allowlist is used to not sync it on every infraction (it is should a ban be imminent)
+	learning := j.learningAt(now)
+	allowed := j.allowlist.Contains(ip)
+	banable := !policy.AlertOnly && !learning && !allowed && quorate
+
+	infractions, err := j.store.AddInfraction(ip, now, policy, banable, 2 * time.Duration(ttl) * time.Second)
+	if err != nil {
+		return err
+	}
+
+	var o strings.Builder
+	o.WriteString("[")
+	for i, v := range infractions {
+		if i > 0 {
+			o.WriteString(" ")
+		}
+		o.WriteString(v.Format("2006-01-02T15:04:05"))
+	}
+	o.WriteString("]")
+	DebugLog("infractions[%s] = %s", ip.String(), o.String())
+
+	previous := infractions[:len(infractions)-1]
+	banned := bannedUntil(previous, policy).After(now)
+
+	if len(infractions) == policy.MaxRetry-1 {
+		j.fire(HookApproach, ip.String(), fmt.Sprintf("%d infractions", len(infractions)))
+	}
+
+	if len(infractions) >= policy.MaxRetry {
+		if policy.AlertOnly {
+			WarningLog("%s not banned despite %d infractions as alert only", ip.String(), len(infractions))
+		} else if learning {
+			WarningLog("%s not banned despite %d infractions as learning", ip.String(), len(infractions))
+		} else if banned {
+			DebugLog("%s ban extended due to %d infractions", ip.String(), len(infractions))
+			// Nor escalated by too few reporters
+			if quorate {
+				if err := j.escalate(ip, policy); err != nil {
+					return err
+				}
+			}
+		} else if allowed {
+			WarningLog("%s not banned despite %d infractions as allowlisted", ip.String(), len(infractions))
+		} else if !quorate {
+			WarningLog("%s not banned despite %d infractions as only %d of %d reporters", ip.String(), len(infractions), reporters, policy.Quorum)
+		} else if !imported && j.allowed(ip) {
+			// Allowlisted elsewhere since last synced, the oldest infraction is dropped as if recorded unbanable
+			WarningLog("%s not banned despite %d infractions as allowlisted", ip.String(), len(infractions))
+			if err := j.store.TrimInfractions(ip, infractions[len(infractions)-policy.MaxRetry]); err != nil {
+				return err
+			}
+			infractions = infractions[len(infractions)-policy.MaxRetry+1:]
+		} else {
+			InfoLog("%s banned due to %d infractions", ip.String(), len(infractions))
+			ban := j.autoBan
+			if imported {
+				ban = j.Ban
+			}
+			if err := ban(ip); err != nil {
+				return err
+			}
+		}
+	}
+
+	// As retained by the store
+	if n := len(infractions) - retainInfractions(previous, policy, banable, now); n > 0 {
+		infractions = infractions[n:]
+	}
+	if len(infractions) == 0 {
+		return j.store.Unschedule(ip.String())
+	}
+
+	if until := bannedUntil(infractions, policy); until.After(now) && j.cacheable(policy, learning) {
+		j.cache.Set(ip, until)
+	}
+
+	return j.store.Schedule(ip.String(), nextDue(infractions, policy, now))
+}
+
+// Expects mux to be held
+func (j *Jail) addScore(ip net.IP, now time.Time, quorate bool) error {
+	var value float64
+	banned, newlyBanned, approached := false, false, false
+
+	err := j.updateScore(ip, func(score *Score) bool {
+		score.Decay(now)
+		previous := score.Value
+		score.Value++
+		approached = !score.Banned && previous < BanScore-1 && score.Value >= BanScore-1 && score.Value < BanScore
+
+		value = score.Value
+		banned = score.Banned
+		newlyBanned = !score.Banned && score.Value >= BanScore
+		if newlyBanned && j.overrides.Policy(ip).AlertOnly {
+			WarningLog("%s not banned despite score %.3f as alert only", ip.String(), value)
+			newlyBanned = false
+		}
+		if newlyBanned && j.learningAt(now) {
+			WarningLog("%s not banned despite score %.3f as learning", ip.String(), value)
+			newlyBanned = false
+		}
+		// The store must not be used from within f, hence the local copy of the allowlist (synced below if banned)
+		if newlyBanned && j.allowlist.Contains(ip) {
+			WarningLog("%s not banned despite score %.3f as allowlisted", ip.String(), value)
+			newlyBanned = false
+		}
+		if newlyBanned && !quorate {
+			WarningLog("%s not banned despite score %.3f as too few reporters", ip.String(), value)
+			newlyBanned = false
+		}
+		if newlyBanned {
+			score.Banned = true
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	if newlyBanned && j.allowed(ip) {
+		WarningLog("%s not banned despite score %.3f as allowlisted", ip.String(), value)
+		return j.updateScore(ip, func(score *Score) bool {
+			score.Banned = false
+			return true
+		})
+	}
+
+	DebugLog("scores[%s] = %.3f", ip.String(), value)
+
+	if approached {
+		j.fire(HookApproach, ip.String(), fmt.Sprintf("score %.3f", value))
+	}
+
+	if newlyBanned {
+		InfoLog("%s banned due to score %.3f", ip.String(), value)
+		return j.autoBan(ip)
+	} else if banned && quorate {
+		return j.escalate(ip, j.overrides.Policy(ip))
+	}
+
+	return nil
+}
+
+// Ban the prefixes of ip that MaxRetry infractions (of any ips within) arrived for within FindTime, expects mux to be held
+func (j *Jail) countSubnets(ip net.IP, reporter string, policy Policy, now time.Time) error {
+	window := time.Duration(policy.FindTime) * time.Second
+
+	for _, subnet := range j.subnets {
+		ipnet := subnet.Prefix(ip)
+		if ipnet == nil {
+			continue
+		}
+		key := subnetPrefix + ipnet.String()
+
+		n, err := j.store.Count(key, now, window)
+		if err != nil {
+			return err
+		}
+
+		reporters := 0
+		if policy.Quorum > 1 {
+			distinct, err := j.store.AddReport(key, reporter, now, window)
+			if err != nil {
+				return err
+			}
+			reporters = len(distinct)
+		}
+
+		if n < subnet.MaxRetry || j.manuallyBanned(ip) {
+			continue
+		}
+
+		if j.learningAt(now) {
+			WarningLog("%s not banned despite %d infractions as learning", ipnet.String(), n)
+		} else if j.allowlist.Overlaps(ipnet) {
+			WarningLog("%s not banned despite %d infractions as overlapping the allowlist", ipnet.String(), n)
+		} else if policy.Quorum > 1 && reporters < policy.Quorum {
+			WarningLog("%s not banned despite %d infractions as only %d of %d reporters", ipnet.String(), n, reporters, policy.Quorum)
+		} else if held, err := j.hold(ipnet); err != nil {
+			return err
+		} else if !held {
+			InfoLog("%s banned due to %d infractions", ipnet.String(), n)
+			expiry := now.Add(time.Duration(policy.BanTime) * time.Second)
+			if err := j.BanCidr(ipnet, expiry, fmt.Sprintf("subnet %d infractions", n)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Promote a banned ip to the next tier once MaxRetry further infractions arrive while in its tier
+func (j *Jail) escalate(ip net.IP, policy Policy) error {
+	if len(j.backends) == 1 {
+		return nil
+	}
+
+	var from, to int
+	err := j.store.UpdateTier(ip, func(tier *Tier) bool {
+		// Not banned by the jail, eg held by the circuit breaker
+		if tier.Level == 0 {
+			return false
+		}
+
+		from, to = tier.Level, tier.Level
+		if tier.Level < len(j.backends) {
+			tier.Infractions++
+			if tier.Infractions >= policy.MaxRetry {
+				*tier = Tier{Level: tier.Level + 1}
+				to = tier.Level
+			}
+		}
+		return true
+	})
+	if err != nil || from == to {
+		return err
+	}
+
+	InfoLog("%s promoted to tier %d", ip.String(), to)
+
+	// Added to the higher tier before being removed from the lower so as to never be unbanned in between
+	ipnet := SingleCidr(ip)
+	lower, higher := j.backends[from-1], j.backends[to-1]
+	j.effect(func() error {
+		if err := higher.Add(ipnet); err != nil {
+			return err
+		}
+		return lower.Del(ipnet)
+	})
+
+	return nil
+}
+
+// Learning lasts from when it was first started (by any process sharing the store) for the learning period
+func (j *Jail) StartLearning(learning Learning) error {
+	if learning.Period == 0 {
+		return nil
+	}
+
+	start, err := j.store.LearningStart(j.now())
+	if err != nil {
+		return err
+	}
+
+	j.learning = learning
+	j.learnUntil = start.Add(time.Duration(learning.Period) * time.Second)
+
+	if j.learningAt(j.now()) {
+		InfoLog("learning until %s, nothing will be banned", j.learnUntil.Format("2006-01-02T15:04:05"))
+	}
+	return nil
+}
+
+func (j *Jail) learningAt(t time.Time) bool {
+	return !j.learnUntil.IsZero() && t.Before(j.learnUntil)
+}
+
+func (j *Jail) recommend() (int, []Recommendation, error) {
+	learnings, err := j.store.Learnings()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return len(learnings), Recommend(learnings, j.learning.Percentiles), nil
+}
+
+func (j *Jail) reportLearning() {
+	ips, recommendations, err := j.recommend()
+	if err != nil {
+		ErrorLog(err.Error())
+		return
+	}
+
+	InfoLog("learning ended with %d ips, recommendations:", ips)
+	for _, r := range recommendations {
+		InfoLog("  %s", r.String())
+	}
+}
+
+func (j *Jail) WriteLearning(w *http.ResponseWriter) error {
+	ips, recommendations, err := j.recommend()
+	if err != nil {
+		return err
+	}
+
+	return WriteLearning(w, j.learningAt(j.now()), j.learnUntil, ips, recommendations)
+}
+
+// Update a score and (re)schedule it for when it will have decayed
+func (j *Jail) updateScore(ip net.IP, f func(score *Score) bool) error {
+	var keep bool
+	var until time.Time
+
+	err := j.store.UpdateScore(ip, func(score *Score) bool {
+		keep = f(score)
+		until = score.DecayedBy(UnbanScore)
+		return keep
+	})
+	if err != nil {
+		return err
+	}
+
+	if !keep {
+		return j.store.Unschedule(ip.String())
+	}
+	return j.store.Schedule(ip.String(), until)
+}
+
+func (j *Jail) manageDue(now time.Time) {
+	keys, err := j.store.Due(now)
+	if err != nil {
+		ErrorLog(err.Error())
+		return
+	}
+
+	for _, key := range keys {
+		if strings.HasPrefix(key, manualBanPrefix) {
+			err = j.expireManualBan(key[len(manualBanPrefix):], now)
+		} else if ip := net.ParseIP(key); ip == nil { // Should never happen
+			ErrorLog("could not parse %s as an ip", key)
+			continue
+		} else if j.model == ScoreModel {
+			err = j.manageScore(ip, now)
+		} else {
+			err = j.manageIp(ip, now)
+		}
+
+		// Due keys are claimed (ie unscheduled) beforehand so would otherwise never be managed again
+		if err != nil {
+			ErrorLog(err.Error())
+			if err := j.store.Schedule(key, now.Add(dueRetryPeriod)); err != nil {
+				ErrorLog(err.Error())
+			}
+		}
+	}
+}
+
+func (j *Jail) unban(ip net.IP) {
+	if j.manuallyBanned(ip) {
+		DebugLog("%s not unbanned as manually banned", ip.String())
+		return
+	}
+
+	if j.breaker.Enabled() {
+		if pending, err := j.store.DelPending(SingleCidr(ip)); err != nil {
+			ErrorLog(err.Error())
+		} else if pending {
+			InfoLog("%s pending ban dropped", ip.String())
+			return
+		}
+	}
+
+	InfoLog("%s is unbanned", ip.String())
+	if err := j.Unban(ip); err != nil {
+		ErrorLog(err.Error())
+		return
+	}
+	j.fire(HookUnban, ip.String(), "")
+}
+
+// Forget expired infractions (unbanning if no longer warranted) and reschedule the ip if still tracked
+func (j *Jail) manageIp(ip net.IP, now time.Time) error {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	infractions, err := j.store.Infractions(ip)
+	if err != nil {
+		return err
+	}
+	if len(infractions) == 0 {
+		return nil
+	}
+
+	policy := j.overrides.Policy(ip)
+	limit := len(infractions)
+
+	endtime := bannedUntil(infractions, policy)
+	if !endtime.IsZero() && now.Before(endtime) {
+		limit = len(infractions) - policy.MaxRetry
+		DebugLog("%s banned until %s", ip.String(), endtime.Format("2006-01-02T15:04:05"))
+	}
+
+	var i int
+	for i = 0; i < limit; i++ {
+		if now.Sub(infractions[i]).Seconds() < float64(policy.FindTime) {
+			break
+		}
+	}
+	// Trimmed by time rather than forgotten should infractions be recorded concurrently
+	if i == len(infractions) {
+		if len(infractions) >= policy.MaxRetry && !policy.AlertOnly {
+			j.unban(ip)
+		}
+
+		if err := j.store.TrimInfractions(ip, infractions[i-1]); err != nil {
+			ErrorLog(err.Error())
+		}
+		DebugLog("%s infractions deleted", ip.String())
+		return nil
+
+	} else if i > 0 {
+		if len(infractions) >= policy.MaxRetry && len(infractions)-i < policy.MaxRetry && !policy.AlertOnly {
+			j.unban(ip)
+		}
+
+		if err := j.store.TrimInfractions(ip, infractions[i-1]); err != nil {
+			ErrorLog(err.Error())
+		}
+		DebugLog("%s %d infractions deleted", ip.String(), i)
+	}
+
+	return j.store.Schedule(ip.String(), nextDue(infractions[i:], policy, now))
+}
+
+// Forget decayed scores (unbanning if banned) and reschedule the ip if still tracked
+func (j *Jail) manageScore(ip net.IP, now time.Time) error {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	var deleted, banned bool
+
+	err := j.updateScore(ip, func(score *Score) bool {
+		score.Decay(now)
+		deleted = score.Value < UnbanScore
+		banned = score.Banned
+		return !deleted
+	})
+	if err != nil {
+		return err
+	}
+
+	if deleted {
+		DebugLog("%s score deleted", ip.String())
+		if banned {
+			j.unban(ip)
+		}
+	}
+	return nil
+}
+
+// Bans start at the lowest tier (unless already tiered, eg imported)
+func (j *Jail) Ban(ip net.IP) error {
+	level := 1
+	if len(j.backends) > 1 {
+		err := j.store.UpdateTier(ip, func(tier *Tier) bool {
+			if tier.Level == 0 {
+				*tier = Tier{Level: 1}
+			}
+			level = tier.Level
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	j.banCidr(j.backends[level-1], SingleCidr(ip))
+	return nil
+}
+
+// Unbanned from its tier, which is then forgotten so that its next ban starts at the lowest tier
+func (j *Jail) Unban(ip net.IP) error {
+	level, err := j.tierLevel(ip)
+	if err != nil {
+		return err
+	}
+
+	j.unbanCidr(j.backends[level-1], SingleCidr(ip))
+	if len(j.backends) > 1 {
+		return j.store.UpdateTier(ip, func(tier *Tier) bool { return false })
+	}
+	return nil
+}
+
+// The tier an ip is banned in (left as is), the lowest if not tiered
+func (j *Jail) tierLevel(ip net.IP) (int, error) {
+	level := 1
+	if len(j.backends) > 1 {
+		err := j.store.UpdateTier(ip, func(tier *Tier) bool {
+			if tier.Level > 0 {
+				level = tier.Level
+			}
+			return tier.Level > 0
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return level, nil
+}
+
+// Automatic bans go through the circuit breaker, being held pending while it is tripped
+func (j *Jail) autoBan(ip net.IP) error {
+	if held, err := j.hold(SingleCidr(ip)); err != nil || held {
+		return err
+	}
+
+	if err := j.Ban(ip); err != nil {
+		return err
+	}
+	j.fire(HookBan, ip.String(), "")
+	return nil
+}
+
+// Whether a ban (of an ip or a subnet) is to be held as the circuit breaker is (or has just been) tripped
+func (j *Jail) hold(ipnet *net.IPNet) (bool, error) {
+	if !j.breaker.Enabled() {
+		return false, nil
+	}
+
+	tripped, err := j.store.Tripped()
+	if err != nil {
+		return false, err
+	}
+
+	now := j.now()
+	if !tripped {
+		limits := []struct {
+			key  string
+			rate BanRate
+		}{
+			{j.rateKey(), j.breaker.Jail},
+			{globalRateKey, j.breaker.Global},
+		}
+
+		for _, limit := range limits {
+			if limit.rate.Bans == 0 {
+				continue
+			}
+
+			n, err := j.store.Count(limit.key, now, time.Duration(limit.rate.Window) * time.Second)
+			if err != nil {
+				return false, err
+			}
+			if n > limit.rate.Bans {
+				ErrorLog("circuit breaker tripped by %d %s bans within %ds, bans held until resumed", n, limit.key, limit.rate.Window)
+				if err := j.store.SetTripped(true); err != nil {
+					return false, err
+				}
+				tripped = true
+				break
+			}
+		}
+	}
+
+	if !tripped {
+		return false, nil
+	}
+
+	WarningLog("%s ban held as circuit breaker tripped", CidrString(ipnet))
+	return true, j.store.AddPending(ipnet, now)
+}
+
+// The jail's ban rate counter, distinct from those of the other jails sharing the store
+func (j *Jail) rateKey() string {
+	return jailRateKey + "-" + j.name
+}
+
+func (j *Jail) fire(event, ip, reason string) {
+	e := HookEvent{Event: event, Ip: ip, Time: j.now(), Jail: j.name, Reason: reason, Origin: j.id}
+	// Still published for the other containers, which were not told of the fallback's bans
+	if event != HookBan || !j.degraded.fired(ip) {
+		j.hooks.Fire(e)
+	}
+	j.publish(e)
+}
+
+// Whether the ban of an ip is still warranted, ie it has not since expired
+func (j *Jail) stillBanned(ip net.IP, now time.Time) (bool, error) {
+	if j.model == ScoreModel {
+		var banned bool
+		err := j.store.UpdateScore(ip, func(score *Score) bool {
+			banned = score.Banned && score.BannedUntil().After(now)
+			return !score.Updated.IsZero()
+		})
+		return banned, err
+	}
+
+	infractions, err := j.store.Infractions(ip)
+	if err != nil {
+		return false, err
+	}
+	return bannedUntil(infractions, j.overrides.Policy(ip)).After(now), nil
+}
+
+// Reset the circuit breaker, effecting the held bans that are still warranted unless discarded
+func (j *Jail) Resume(discard bool) error {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	if err := j.store.SetTripped(false); err != nil {
+		return err
+	}
+
+	pending, err := j.store.Pending()
+	if err != nil {
+		return err
+	}
+
+	now := j.now()
+	for _, ban := range pending {
+		if _, err := j.store.DelPending(ban.IpNet); err != nil {
+			return err
+		}
+		if discard {
+			continue
+		}
+
+		// Subnet bans last BanTime from the latest infraction warranting them, ie from when last held
+		if !IsSingleCidr(ban.IpNet) {
+			expiry := ban.Held.Add(time.Duration(j.overrides.Policy(ban.IpNet.IP).BanTime) * time.Second)
+			if !now.Before(expiry) {
+				DebugLog("%s pending ban expired", ban.IpNet.String())
+				continue
+			}
+
+			InfoLog("%s pending ban effected", ban.IpNet.String())
+			if err := j.BanCidr(ban.IpNet, expiry, "subnet (held)"); err != nil {
+				return err
+			}
+			continue
+		}
+		ip := ban.IpNet.IP
+
+		banned, err := j.stillBanned(ip, now)
+		if err != nil {
+			return err
+		}
+		if !banned {
+			DebugLog("%s pending ban expired", ip.String())
+			continue
+		}
+
+		InfoLog("%s pending ban effected", ip.String())
+		if err := j.Ban(ip); err != nil {
+			return err
+		}
+		j.fire(HookBan, ip.String(), "")
+	}
+
+	return nil
+}
+
+func (j *Jail) WriteBreaker(w *http.ResponseWriter) error {
+	tripped, err := j.store.Tripped()
+	if err != nil {
+		return err
+	}
+	pending, err := j.store.Pending()
+	if err != nil {
+		return err
+	}
+
+	return WriteBreaker(w, j.breaker, tripped, pending)
+}
+
+// Backend updates can be slow (eg the aws cli) hence are effected asynchronously
+func (j *Jail) effect(f func() error) {
+	if j.simulated {
+		if err := f(); err != nil {
+			ErrorLog(err.Error())
+		}
+		return
+	}
+
+	go func() {
+		if err := f(); err != nil {
+			ErrorLog(err.Error())
+		}
+	}()
+}
+
+func (j *Jail) banCidr(backend Backend, ipnet *net.IPNet) {
+	j.effect(func() error { return backend.Add(ipnet) })
+}
+
+func (j *Jail) unbanCidr(backend Backend, ipnet *net.IPNet) {
+	j.effect(func() error { return backend.Del(ipnet) })
+}
+
+// The manual ban of exactly ipnet if any
+func (j *Jail) manualBan(ipnet *net.IPNet) (*ManualBan, error) {
+	bans, err := j.store.ManualBans()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ban := range bans {
+		if ban.IpNet.String() == ipnet.String() {
+			return &ban, nil
+		}
+	}
+	return nil, nil
+}
+
+// Only called when an unban is imminent
+func (j *Jail) manuallyBanned(ip net.IP) bool {
+	bans, err := j.store.ManualBans()
+	if err != nil {
+		ErrorLog(err.Error())
+		return false
+	}
+
+	now := j.now()
+	for _, ban := range bans {
+		if (ban.Expiry.IsZero() || now.Before(ban.Expiry)) && ban.IpNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (j *Jail) expireManualBan(cidr string, now time.Time) error {
+	ipnet, err := ParseCidr(cidr)
+	if err != nil {
+		return err
+	}
+
+	ban, err := j.manualBan(ipnet)
+	if err != nil {
+		return err
+	}
+	if ban == nil || ban.Expiry.IsZero() || now.Before(ban.Expiry) {
+		return nil
+	}
+
+	// Manual bans are in the block tier, a single ip may also be (or have been) automatically banned in its own tier
+	var banned bool
+	level := len(j.backends)
+	if IsSingleCidr(ipnet) {
+		if banned, err = j.stillBanned(ipnet.IP, now); err != nil {
+			return err
+		}
+		if level, err = j.tierLevel(ipnet.IP); err != nil {
+			return err
+		}
+	}
+
+	if err := j.store.DelManualBan(ipnet); err != nil {
+		return err
+	}
+
+	InfoLog("%s manual ban expired", cidr)
+	if !banned || level < len(j.backends) {
+		j.unbanCidr(j.backend, ipnet)
+	}
+	if banned {
+		InfoLog("%s still banned by its infractions", cidr)
+		return nil
+	}
+	// Its automatic ban was left in place on ending as it was manually banned (see unban)
+	if level < len(j.backends) {
+		j.unbanCidr(j.backends[level-1], ipnet)
+	}
+
+	j.fire(HookUnban, cidr, "manual ban expired")
+	return nil
+}
+
+func (j *Jail) BanCidr(ipnet *net.IPNet, expiry time.Time, reason string) error {
+	if err := j.store.SetManualBan(ManualBan{IpNet: ipnet, Expiry: expiry, Reason: reason}); err != nil {
+		return err
+	}
+
+	key := manualBanPrefix + ipnet.String()
+	if !expiry.IsZero() {
+		if err := j.store.Schedule(key, expiry); err != nil {
+			return err
+		}
+	} else if err := j.store.Unschedule(key); err != nil {
+		return err
+	}
+
+	j.banCidr(j.backend, ipnet)
+	j.fire(HookBan, ipnet.String(), reason)
+	return nil
+}
+
+func (j *Jail) Forgive(ipnet *net.IPNet) error {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	if err := j.store.DelManualBan(ipnet); err != nil {
+		return err
+	}
+	if err := j.store.Unschedule(manualBanPrefix + ipnet.String()); err != nil {
+		return err
+	}
+
+	ips, err := j.store.IpsWithin(ipnet)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		// Unbanned from its tier if tiered
+		if !IsSingleCidr(ipnet) || len(j.backends) > 1 {
+			if err := j.Unban(ip); err != nil {
+				return err
+			}
+		}
+		if err := j.store.Forget(ip); err != nil {
+			return err
+		}
+		if err := j.store.Unschedule(ip.String()); err != nil {
+			return err
+		}
+	}
+
+	j.unbanCidr(j.backend, ipnet)
+	j.fire(HookUnban, ipnet.String(), "forgiven")
+	return nil
+}
+
+func (j *Jail) WriteBans(w *http.ResponseWriter) error {
+	bans, err := j.store.ManualBans()
+	if err != nil {
+		return err
+	}
+
+	return WriteManualBans(w, bans)
+}
+
+// Refresh the local copy of the temporary allowlist entries, removing expired entries
+func (j *Jail) syncAllowlist() error {
+	entries, err := j.store.Allows()
+	if err != nil {
+		return err
+	}
+
+	now := j.now()
+	current := []TemporaryAllow{}
+	for _, entry := range entries {
+		if !entry.Expiry.IsZero() && now.After(entry.Expiry) {
+			if err := j.store.DelAllow(entry.IpNet); err != nil {
+				ErrorLog(err.Error())
+			}
+			continue
+		}
+		current = append(current, entry)
+	}
+
+	j.allowlist.SetTemporary(current)
+	return nil
+}
+
+// Only called when a ban is imminent so the cost of syncing is acceptable
+func (j *Jail) allowed(ip net.IP) bool {
+	if err := j.syncAllowlist(); err != nil {
+		ErrorLog(err.Error())
+	}
+	return j.allowlist.Contains(ip)
+}
+
+// Whether a cidr overlaps any allowlist entry, the temporary entries synced first
+func (j *Jail) Allowed(ipnet *net.IPNet) bool {
+	if err := j.syncAllowlist(); err != nil {
+		ErrorLog(err.Error())
+	}
+	return j.allowlist.Overlaps(ipnet)
+}
+
+func (j *Jail) Allow(ipnet *net.IPNet, expiry time.Time, reason string) error {
+	entry := TemporaryAllow{IpNet: ipnet, Expiry: expiry, Reason: reason}
+	if err := j.store.SetAllow(entry); err != nil {
+		return err
+	}
+
+	j.allowlist.AddTemporary(ipnet, expiry, reason)
+	return nil
+}
+
+func (j *Jail) Disallow(ipnet *net.IPNet) error {
+	if err := j.store.DelAllow(ipnet); err != nil {
+		return err
+	}
+
+	j.allowlist.DelTemporary(ipnet)
+	return nil
+}
+
+// Of an ip for the state view, as json
+type stateView struct {
+	Ip          string      `json:"ip"`
+	Infractions []time.Time `json:"infractions,omitempty"`
+	Score       *float64    `json:"score,omitempty"`
+	BannedUntil *time.Time  `json:"banned_until,omitempty"`
+	Tier        int         `json:"tier,omitempty"`
+}
+
+func (j *Jail) WriteState(w *http.ResponseWriter, query StateQuery) error {
+	states, cursor, err := j.store.States(query.Cursor, query.Count)
+	if err != nil {
+		return err
+	}
+
+	now := j.now()
+	views := []stateView{}
+	for _, state := range states {
+		if query.Within != nil && !query.Within.Contains(state.Ip) {
+			continue
+		}
+
+		view := stateView{Ip: state.Ip.String()}
+		var endtime time.Time
+		if state.Score != nil {
+			state.Score.Decay(now)
+			view.Score = &state.Score.Value
+			endtime = state.Score.BannedUntil()
+		} else {
+			view.Infractions = state.Infractions
+			endtime = bannedUntil(state.Infractions, j.overrides.Policy(state.Ip))
+		}
+		if endtime.After(now) {
+			view.BannedUntil = &endtime
+		} else if query.Banned {
+			continue
+		}
+		if state.Tier != nil {
+			view.Tier = state.Tier.Level
+		}
+
+		views = append(views, view)
+	}
+
+	if query.Json {
+		return json.NewEncoder(*w).Encode(struct {
+			Ips    []stateView `json:"ips"`
+			Cursor string      `json:"cursor,omitempty"`
+		}{views, cursor})
+	}
+
+	table := make(map[string]string)
+	for _, view := range views {
+		pretty := ""
+
+		if view.Score != nil {
+			pretty = fmt.Sprintf(" score %.3f", *view.Score)
+		} else {
+			for _, t := range view.Infractions {
+				pretty += t.Format(" 2006-01-02T15:04:05")
+			}
+		}
+		if view.BannedUntil != nil {
+			pretty += view.BannedUntil.Format(" (banned until 2006-01-02T15:04:05)")
+		}
+		if view.Tier != 0 {
+			pretty += fmt.Sprintf(" (tier %d of %d)", view.Tier, len(j.backends))
+		}
+
+		table[view.Ip] = pretty
+	}
+
+	if cursor != "" {
+		table["next page"] = fmt.Sprintf("<a href=\"?%s\">more</a>", html.EscapeString(query.Next(cursor).Encode()))
+	}
+
+	return WriteTable(w, table)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Events are published to a stream shared by the processes sharing the store (the hook events plus each infraction)
+// and consumed by every process, eg for live dashboards (see Handler) or local caches
+const EventInfraction = "infraction"
+
+const (
+	eventLimit = 10000 // Retained in the stream, approximately in service mode
+	eventWait = 5 * time.Second
+	eventBuffer = 100 // Per subscriber, events are dropped for slower subscribers
+)
+
+// Consume the stream invalidating the ban cache and dispatching to the subscribers, until closed
+func (j *Jail) consume() {
+	cursor := ""
+	for {
+		select {
+			case <-j.quitChan:
+				return
+			default:
+		}
+
+		events, next, err := j.store.Events(cursor, eventWait)
+		if err != nil {
+			ErrorLog(err.Error())
+			time.Sleep(time.Second)
+			continue
+		}
+		cursor = next
+
+		if j.cache != nil {
+			for _, event := range events {
+				if event.Event != HookUnban {
+					continue
+				}
+				if ipnet, err := ParseCidr(event.Ip); err == nil {
+					j.cache.Invalidate(ipnet)
+				}
+			}
+		}
+
+		j.subsMux.Lock()
+		for _, event := range events {
+			for sub := range j.subs {
+				select {
+					case sub <- event:
+					default:
+						DebugLog("%s %s event dropped for a slow subscriber", event.Event, event.Ip)
+				}
+			}
+		}
+		j.subsMux.Unlock()
+	}
+}
+
+// Events from now on until unsubscribed
+func (j *Jail) Subscribe() (<-chan HookEvent, func()) {
+	sub := make(chan HookEvent, eventBuffer)
+
+	j.subsMux.Lock()
+	defer j.subsMux.Unlock()
+	j.subs[sub] = true
+
+	return sub, func() {
+		j.subsMux.Lock()
+		defer j.subsMux.Unlock()
+		delete(j.subs, sub)
+	}
+}
+
+func (j *Jail) publish(event HookEvent) {
+	if err := j.store.Publish(event); err != nil {
+		ErrorLog(err.Error())
+	}
+}
+
+// Stream events as server-sent events until the client disconnects, optionally only those of the given types
+// Ref: https://html.spec.whatwg.org/multipage/server-sent-events.html
+func WriteEvents(w http.ResponseWriter, r *http.Request, events <-chan HookEvent, types map[string]bool) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return fmt.Errorf("streaming unsupported")
+	}
+	flusher.Flush()
+
+	for {
+		select {
+			case <-r.Context().Done():
+				return nil
+			case event := <-events:
+				if len(types) > 0 && !types[event.Event] {
+					continue
+				}
+
+				data, err := json.Marshal(event)
+				if err != nil {
+					return err
+				}
+				if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Event, data); err != nil {
+					return err
+				}
+				flusher.Flush()
+		}
+	}
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -11,6 +13,10 @@ import (
 
 type Handler struct {
 	jailer       Jailer
+	allowlist    *Allowlist
+	hooks        *Hooks
+	adminToken   string
+	proxies      []*net.IPNet // Trusted to append the reporter's address to X-Forwarded-For
 
 	responsesMux sync.Mutex
 	responses    map[string](map[int]int) // Http response code counts
@@ -18,11 +24,15 @@ type Handler struct {
 	quitChan     chan bool
 }
 
-func NewHandler(jailer Jailer) (*Handler, error) {
+func NewHandler(jailer Jailer, allowlist *Allowlist, hooks *Hooks, adminToken string, proxies []*net.IPNet) (*Handler, error) {
 	handler := &Handler{
-		   jailer: jailer,
-		responses: make(map[string](map[int]int)),
-		 quitChan: make(chan bool),
+		    jailer: jailer,
+		 allowlist: allowlist,
+		     hooks: hooks,
+		adminToken: adminToken,
+		   proxies: proxies,
+		 responses: make(map[string](map[int]int)),
+		  quitChan: make(chan bool),
 	}
 
 	go func() {
@@ -40,6 +50,9 @@ func NewHandler(jailer Jailer) (*Handler, error) {
 						}
 						InfoLog("stats: %s:%s", uri, pretty)
 					}
+					if health := handler.jailer.Health(); health.Degraded {
+						WarningLog("stats: %s", health.String())
+					}
 
 					handler.responsesMux.Unlock()
 			}
@@ -54,6 +67,40 @@ func (h *Handler) Close() error {
 	return nil
 }
 
+// The reporter's own address rather than anything it claims, see Policy.Quorum.
+// Behind trusted proxies (eg a load balancer) it is the address the last of them appended to X-Forwarded-For.
+func (h *Handler) reporter(r *http.Request) string {
+	reporter, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		reporter = r.RemoteAddr
+	}
+
+	// Read from the right as each proxy appends the address it received from, the leftmost are the client's claims
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && h.trusted(reporter); i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(addr) == nil {
+			break
+		}
+		reporter = addr
+	}
+	return reporter
+}
+
+func (h *Handler) trusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, ipnet := range h.proxies {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	respond := func(code int) {
 		w.WriteHeader(code)
@@ -64,6 +111,16 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		uri := r.RequestURI
 		if strings.HasPrefix(uri, "/infraction/") {
 			uri = "/infraction/*"
+		} else if strings.HasPrefix(uri, "/admin/") {
+			// Strip the ip/cidr and query params
+			t := strings.SplitN(r.URL.Path, "/", 4)
+			uri = r.Method + " " + strings.Join(t[:3], "/")
+			if len(t) == 4 {
+				uri += "/*"
+			}
+		} else if strings.HasPrefix(uri, "/state/") {
+			// Strip the query params
+			uri = r.URL.Path
 		}
 
 		if _, ok := h.responses[uri]; !ok {
@@ -84,7 +141,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if err := h.jailer.AddInfraction(ip); err != nil {
+		if err := h.jailer.AddInfraction(ip, h.reporter(r)); err != nil {
 			ErrorLog(err.Error())
 			respond(http.StatusServiceUnavailable)
 			return
@@ -92,11 +149,55 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		respond(http.StatusOK)
 
 	} else if r.RequestURI == "/" {
+		// Still healthy when degraded as infractions are handled locally meanwhile
 		respond(http.StatusOK)
+		if _, err := fmt.Fprintf(w, "%s\n", h.jailer.Health().String()); err != nil {
+			ErrorLog(err.Error())
+		}
+
+	} else if r.URL.Path == "/state/infractions" {
+		query, err := stateQuery(r)
+		if err != nil {
+			WarningLog(err.Error())
+			respond(http.StatusBadRequest)
+			return
+		}
+
+		if query.Json {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		respond(http.StatusOK)
+		if err := h.jailer.WriteState(&w, query); err != nil {
+			ErrorLog(err.Error())
+		}
 
-	} else if r.RequestURI == "/state/infractions" {
+	} else if r.RequestURI == "/state/health" {
 		respond(http.StatusOK)
-		if err := h.jailer.WriteState(&w); err != nil {
+		if err := WriteHealth(&w, h.jailer.Health()); err != nil {
+			ErrorLog(err.Error())
+		}
+
+	} else if r.RequestURI == "/state/leader" {
+		respond(http.StatusOK)
+		if err := h.jailer.WriteLeader(&w); err != nil {
+			ErrorLog(err.Error())
+		}
+
+	} else if r.URL.Path == "/state/events" {
+		types := make(map[string]bool)
+		if s := r.URL.Query().Get("events"); s != "" {
+			for _, t := range strings.Split(s, ",") {
+				types[t] = true
+			}
+		}
+
+		events, unsubscribe := h.jailer.Subscribe()
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		respond(http.StatusOK)
+		if err := WriteEvents(w, r, events, types); err != nil {
 			ErrorLog(err.Error())
 		}
 
@@ -119,8 +220,209 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			ErrorLog(err.Error())
 		}
 
+	} else if strings.HasPrefix(r.URL.Path, "/admin/") {
+		if !h.authorized(r) {
+			WarningLog("unauthorized %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			respond(http.StatusUnauthorized)
+			return
+		}
+		h.serveAdmin(w, r, respond)
+
 	} else {
 		WarningLog("unsupported uri: %s", r.RequestURI)
 		respond(http.StatusNotFound)
 	}
 }
+
+// Admin endpoints are disabled unless a token is configured
+func (h *Handler) authorized(r *http.Request) bool {
+	if h.adminToken == "" {
+		return false
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.adminToken)) == 1
+}
+
+// Optional positive number of seconds query param, zero if absent
+func durationParam(r *http.Request, name string) (time.Duration, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return 0, nil
+	}
+
+	secs, err := strconv.Atoi(s)
+	if err != nil || secs <= 0 {
+		return 0, fmt.Errorf("%q is not a valid %s", s, name)
+	}
+	return time.Duration(secs) * time.Second, nil
+}
+
+// Pages are of 100 ips (before filtering) by default, json if requested by format=json or the Accept header
+func stateQuery(r *http.Request) (StateQuery, error) {
+	params := r.URL.Query()
+	query := StateQuery{
+		Cursor: params.Get("cursor"),
+		 Count: 100,
+		Banned: params.Get("banned") != "",
+		  Json: params.Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json"),
+	}
+
+	if s := params.Get("count"); s != "" {
+		count, err := strconv.Atoi(s)
+		if err != nil || count <= 0 || count > 1000 {
+			return StateQuery{}, fmt.Errorf("%q is not a valid count", s)
+		}
+		query.Count = count
+	}
+
+	if s := params.Get("prefix"); s != "" {
+		ipnet, err := ParseCidr(s)
+		if err != nil {
+			return StateQuery{}, err
+		}
+		query.Within = ipnet
+	}
+
+	return query, nil
+}
+
+func (h *Handler) serveAdmin(w http.ResponseWriter, r *http.Request, respond func(code int)) {
+	if r.URL.Path == "/admin/bans" && r.Method == http.MethodGet {
+		respond(http.StatusOK)
+		if err := h.jailer.WriteBans(&w); err != nil {
+			ErrorLog(err.Error())
+		}
+
+	} else if strings.HasPrefix(r.URL.Path, "/admin/bans/") {
+		ipnet, err := ParseCidr(r.URL.Path[len("/admin/bans/"):])
+		if err != nil {
+			WarningLog(err.Error())
+			respond(http.StatusBadRequest)
+			return
+		}
+
+		switch r.Method {
+			case http.MethodPost:
+				duration, err := durationParam(r, "duration")
+				if err != nil {
+					WarningLog(err.Error())
+					respond(http.StatusBadRequest)
+					return
+				}
+				var expiry time.Time
+				if duration > 0 {
+					expiry = time.Now().Add(duration)
+				}
+				reason := r.URL.Query().Get("reason")
+
+				if h.jailer.Allowed(ipnet) {
+					WarningLog("%s not banned as allowlisted", ipnet.String())
+					respond(http.StatusConflict)
+					return
+				}
+
+				if err := h.jailer.BanCidr(ipnet, expiry, reason); err != nil {
+					ErrorLog(err.Error())
+					respond(http.StatusServiceUnavailable)
+					return
+				}
+				InfoLog("%s manually banned (duration %q): %s", ipnet.String(), r.URL.Query().Get("duration"), reason)
+				respond(http.StatusOK)
+
+			case http.MethodDelete:
+				if err := h.jailer.Forgive(ipnet); err != nil {
+					ErrorLog(err.Error())
+					respond(http.StatusServiceUnavailable)
+					return
+				}
+				InfoLog("%s manually unbanned and forgiven", ipnet.String())
+				respond(http.StatusOK)
+
+			default:
+				respond(http.StatusMethodNotAllowed)
+		}
+
+	} else if r.URL.Path == "/admin/allowlist" && r.Method == http.MethodGet {
+		respond(http.StatusOK)
+		if err := h.allowlist.WriteState(&w); err != nil {
+			ErrorLog(err.Error())
+		}
+
+	} else if strings.HasPrefix(r.URL.Path, "/admin/allowlist/") {
+		ipnet, err := ParseCidr(r.URL.Path[len("/admin/allowlist/"):])
+		if err != nil {
+			WarningLog(err.Error())
+			respond(http.StatusBadRequest)
+			return
+		}
+
+		switch r.Method {
+			case http.MethodPost:
+				ttl, err := durationParam(r, "ttl")
+				if err != nil {
+					WarningLog(err.Error())
+					respond(http.StatusBadRequest)
+					return
+				}
+				var expiry time.Time
+				if ttl > 0 {
+					expiry = time.Now().Add(ttl)
+				}
+				reason := r.URL.Query().Get("reason")
+
+				if err := h.jailer.Allow(ipnet, expiry, reason); err != nil {
+					ErrorLog(err.Error())
+					respond(http.StatusServiceUnavailable)
+					return
+				}
+				InfoLog("%s allowlisted (ttl %q): %s", ipnet.String(), r.URL.Query().Get("ttl"), reason)
+				respond(http.StatusOK)
+
+			case http.MethodDelete:
+				if err := h.jailer.Disallow(ipnet); err != nil {
+					ErrorLog(err.Error())
+					respond(http.StatusServiceUnavailable)
+					return
+				}
+				InfoLog("%s removed from allowlist", ipnet.String())
+				respond(http.StatusOK)
+
+			default:
+				respond(http.StatusMethodNotAllowed)
+		}
+
+	} else if r.URL.Path == "/admin/breaker" && r.Method == http.MethodGet {
+		respond(http.StatusOK)
+		if err := h.jailer.WriteBreaker(&w); err != nil {
+			ErrorLog(err.Error())
+		}
+
+	} else if r.URL.Path == "/admin/breaker/resume" && r.Method == http.MethodPost {
+		discard := r.URL.Query().Get("discard") != ""
+
+		if err := h.jailer.Resume(discard); err != nil {
+			ErrorLog(err.Error())
+			respond(http.StatusServiceUnavailable)
+			return
+		}
+		InfoLog("circuit breaker resumed (pending bans discarded %t)", discard)
+		respond(http.StatusOK)
+
+	} else if r.URL.Path == "/admin/hooks" && r.Method == http.MethodGet {
+		respond(http.StatusOK)
+		if err := h.hooks.WriteState(&w); err != nil {
+			ErrorLog(err.Error())
+		}
+
+	} else if r.URL.Path == "/admin/learning" && r.Method == http.MethodGet {
+		respond(http.StatusOK)
+		if err := h.jailer.WriteLearning(&w); err != nil {
+			ErrorLog(err.Error())
+		}
+
+	} else {
+		WarningLog("unsupported admin uri: %s %s", r.Method, r.URL.Path)
+		respond(http.StatusNotFound)
+	}
+}
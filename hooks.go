@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hook events, fail2ban's actionban and actionunban plus an infraction short of a ban
+const (
+	HookBan = "ban"
+	HookUnban = "unban"
+	HookApproach = "approach"
+)
+
+const (
+	hookTimeout = 10 // In seconds
+	hookRetries = 2
+)
+
+// Also published to the event stream, see EventInfraction
+type HookEvent struct {
+	Event  string    `json:"event"`
+	Ip     string    `json:"ip"` // Or cidr for manual bans
+	Time   time.Time `json:"time"`
+	Jail   string    `json:"jail"`
+	Reason string    `json:"reason,omitempty"`
+	Origin string    `json:"origin,omitempty"` // The process, see processId
+}
+
+// Actions fired on ban, unban and approach events independently of the ip set updates.
+// Read from a file with one hook per line of the event (or * for all), optional timeout (secs) and retries
+// then either exec and a command or http and a url, eg:
+//   ban exec /usr/local/bin/notify --ip <ip> --jail <jail>
+//   * timeout=5 retries=3 http https://hooks.example.com/fail2ban?ip=<ip>
+// Arguments and urls are templated with <event>, <ip>, <time> (unix timestamp), <jail> and <reason>.
+// Http callbacks are posted the event as json.
+type Hooks struct {
+	path  string
+	jail  string
+
+	mux   sync.Mutex
+	hooks []hook
+	stats map[string]*hookStats // By hook line
+}
+
+type hook struct {
+	line    string
+	event   string
+	kind    string
+	args    []string // Command and arguments or url
+	timeout time.Duration
+	retries int
+}
+
+type hookStats struct {
+	succeeded int
+	failed    int
+	lastError string
+}
+
+func NewHooks(path, jail string) (*Hooks, error) {
+	hooks := &Hooks{path: path, jail: jail, stats: make(map[string]*hookStats)}
+
+	if err := hooks.Reload(); err != nil {
+		return nil, err
+	}
+
+	return hooks, nil
+}
+
+func parseHook(line string) (hook, error) {
+	fields := strings.Fields(line)
+
+	h := hook{
+		   line: line,
+		  event: fields[0],
+		timeout: hookTimeout * time.Second,
+		retries: hookRetries,
+	}
+
+	switch h.event {
+		case HookBan, HookUnban, HookApproach, "*":
+		default:
+			return hook{}, fmt.Errorf("unsupported hook event %q", h.event)
+	}
+
+	i := 1
+	for ; i < len(fields) && strings.Contains(fields[i], "="); i++ {
+		t := strings.SplitN(fields[i], "=", 2)
+		v, err := strconv.Atoi(t[1])
+		if err != nil || v < 0 {
+			return hook{}, fmt.Errorf("invalid hook %s value %q", t[0], t[1])
+		}
+
+		switch t[0] {
+			case "timeout":
+				h.timeout = time.Duration(v) * time.Second
+			case "retries":
+				h.retries = v
+			default:
+				return hook{}, fmt.Errorf("unsupported hook option %q", t[0])
+		}
+	}
+
+	if i+1 >= len(fields) || (fields[i] != "exec" && fields[i] != "http") {
+		return hook{}, fmt.Errorf("hook %q is missing exec <command> or http <url>", line)
+	}
+	h.kind = fields[i]
+	h.args = fields[i+1:]
+
+	return h, nil
+}
+
+func (h *Hooks) Reload() error {
+	if h.path == "" {
+		return nil
+	}
+
+	file, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hooks := []hook{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		entry, err := parseHook(line)
+		if err != nil {
+			return err
+		}
+		hooks = append(hooks, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	h.hooks = hooks
+	InfoLog("hooks: %d entries loaded", len(hooks))
+
+	return nil
+}
+
+// Run the hooks of the event asynchronously, failures are logged and counted
+func (h *Hooks) Fire(event HookEvent) {
+	if h == nil {
+		return
+	}
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	event.Jail = h.jail
+	for _, entry := range h.hooks {
+		if entry.event != event.Event && entry.event != "*" {
+			continue
+		}
+
+		go func(entry hook) {
+			err := entry.run(event)
+
+			h.mux.Lock()
+			defer h.mux.Unlock()
+
+			stats, ok := h.stats[entry.line]
+			if !ok {
+				stats = &hookStats{}
+				h.stats[entry.line] = stats
+			}
+			if err != nil {
+				ErrorLog("hook %q failed for %s %s: %s", entry.line, event.Event, event.Ip, err.Error())
+				stats.failed++
+				stats.lastError = err.Error()
+			} else {
+				stats.succeeded++
+			}
+		}(entry)
+	}
+}
+
+func (h hook) run(event HookEvent) error {
+	replacer := strings.NewReplacer(
+		"<event>", event.Event,
+		"<ip>", event.Ip,
+		"<time>", strconv.FormatInt(event.Time.Unix(), 10),
+		"<jail>", event.Jail,
+		"<reason>", event.Reason,
+	)
+
+	args := []string{}
+	for _, arg := range h.args {
+		args = append(args, replacer.Replace(arg))
+	}
+
+	var err error
+	for n := 0; n <= h.retries; n++ {
+		if n > 0 {
+			time.Sleep(time.Duration(1 << (n-1)) * time.Second)
+			DebugLog("hook %q attempt %d", h.line, n+1)
+		}
+
+		if h.kind == "exec" {
+			err = h.exec(args)
+		} else {
+			err = h.post(args[0], event)
+		}
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (h hook) exec(args []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		if len(output) > 200 {
+			output = output[:200]
+		}
+		return fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (h hook) post(url string, event HookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{Timeout: h.timeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("http status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (h *Hooks) WriteState(w *http.ResponseWriter) error {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	table := make(map[string]string)
+	for _, entry := range h.hooks {
+		pretty := "never fired"
+		if stats, ok := h.stats[entry.line]; ok {
+			pretty = fmt.Sprintf("succeeded %d failed %d", stats.succeeded, stats.failed)
+			if stats.lastError != "" {
+				pretty += " (last error: " + html.EscapeString(stats.lastError) + ")"
+			}
+		}
+		table[html.EscapeString(entry.line)] = pretty
+	}
+
+	return WriteTable(w, table)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A jail imported from fail2ban jail.conf/jail.local files, only the subset with an equivalent here is supported.
+// Ref: https://manpages.debian.org/unstable/fail2ban/jail.conf.5.en.html
+type JailConf struct {
+	Name        string
+	Policy      Policy
+	IgnoreIp    []string
+	Unsupported []string // Options ignored, as "<section>: <option>" with a reason if any
+}
+
+// Options with an equivalent, only these are interpolated
+var jailConfSupported = map[string]bool{
+	"enabled": true, "maxretry": true, "findtime": true, "bantime": true, "ignoreip": true, "ignoreself": true,
+}
+
+// Log parsing and action plumbing options, not applicable as infractions are reported to and bans effected by the jailer
+var jailConfNotApplicable = map[string]bool{
+	"filter": true, "logpath": true, "logencoding": true, "backend": true, "journalmatch": true, "usedns": true,
+	"port": true, "protocol": true, "chain": true, "action": true, "banaction": true, "banaction_allports": true,
+}
+
+// Read the jail's options from the files in order (later ones overriding earlier ones, eg jail.conf then jail.local).
+// Options of the [DEFAULT] section apply unless given in the jail's own section.
+func ParseJailConf(paths []string, name string) (JailConf, error) {
+	sections := make(map[string](map[string]string))
+	for _, path := range paths {
+		if err := readJailConf(path, sections); err != nil {
+			return JailConf{}, err
+		}
+	}
+
+	section, ok := sections[name]
+	if !ok {
+		return JailConf{}, fmt.Errorf("jail %q not found in %s", name, strings.Join(paths, ","))
+	}
+
+	options := make(map[string]string)
+	for k, v := range sections["DEFAULT"] {
+		options[k] = v
+	}
+	for k, v := range section {
+		options[k] = v
+	}
+
+	conf := JailConf{Name: name, Policy: DefaultPolicy, IgnoreIp: []string{}, Unsupported: []string{}}
+	unsupported := func(option, reason string) {
+		if reason != "" {
+			option += " (" + reason + ")"
+		}
+		conf.Unsupported = append(conf.Unsupported, name + ": " + option)
+	}
+
+	// Eg the distribution's paths-*.conf defining the log paths and backends
+	includes := []string{}
+	for k := range sections["INCLUDES"] {
+		includes = append(includes, k)
+	}
+	sort.Strings(includes)
+	for _, k := range includes {
+		option := "INCLUDES: " + k + " = " + sections["INCLUDES"][k] + " (not read, give the files with -c if need be)"
+		conf.Unsupported = append(conf.Unsupported, option)
+	}
+
+	keys := []string{}
+	for k := range options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := options[k]
+		if jailConfSupported[k] {
+			var err error
+			// Eg a variable of an included file or %(__name__)s
+			if v, err = interpolate(v, options, 0); err != nil {
+				unsupported(k + " = " + options[k], err.Error())
+				continue
+			}
+		}
+
+		switch k {
+			case "enabled":
+				enabled, err := strconv.ParseBool(v)
+				if err != nil {
+					return JailConf{}, fmt.Errorf("invalid enabled value %q in jail %s", v, name)
+				}
+				// A disabled jail is imported as alert only rather than refusing to start
+				if !enabled {
+					conf.Policy.AlertOnly = true
+				}
+
+			case "maxretry":
+				n, err := strconv.Atoi(v)
+				if err != nil || n <= 0 {
+					return JailConf{}, fmt.Errorf("invalid maxretry value %q in jail %s", v, name)
+				}
+				conf.Policy.MaxRetry = n
+
+			case "findtime", "bantime":
+				secs, err := ParseJailTime(v)
+				if err != nil {
+					return JailConf{}, fmt.Errorf("%s in jail %s", err.Error(), name)
+				}
+				if secs <= 0 && k == "bantime" {
+					unsupported(k + " = " + v, "permanent automatic bans, use a manual ban instead")
+					continue
+				} else if secs <= 0 {
+					return JailConf{}, fmt.Errorf("invalid findtime value %q in jail %s", v, name)
+				}
+				if k == "findtime" {
+					conf.Policy.FindTime = secs
+				} else {
+					conf.Policy.BanTime = secs
+				}
+
+			case "ignoreip":
+				for _, s := range strings.FieldsFunc(v, func(r rune) bool { return r == ' ' || r == ',' || r == '\n' || r == '\t' }) {
+					if _, err := ParseCidr(s); err != nil {
+						unsupported("ignoreip " + s, "not an ip or cidr")
+						continue
+					}
+					conf.IgnoreIp = append(conf.IgnoreIp, s)
+				}
+
+			case "ignoreself":
+				if self, err := strconv.ParseBool(v); err != nil || self {
+					unsupported(k + " = " + v, "add the load balancer and host addresses to ignoreip")
+				}
+
+			default:
+				// The score model is the nearest equivalent but does not use the imported policy
+				if strings.HasPrefix(k, "bantime.") {
+					unsupported(k, "ban times are not incremented, see the score model (-m score)")
+				} else if _, own := section[k]; !own {
+					// Likely a variable for interpolation, eg the distribution's log paths
+					continue
+				} else if jailConfNotApplicable[k] {
+					unsupported(k, "not applicable")
+				} else {
+					unsupported(k, "")
+				}
+		}
+	}
+
+	return conf, nil
+}
+
+// Parse an ini style file into sections of lower case options, continuation lines are indented
+func readJailConf(path string, sections map[string](map[string]string)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var section map[string]string
+	var last string
+
+	n := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		n++
+		line := scanner.Text()
+
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed[0] == '#' || trimmed[0] == ';' {
+			continue
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			if section == nil || last == "" {
+				return fmt.Errorf("%s:%d: unexpected continuation line", path, n)
+			}
+			section[last] += "\n" + stripJailConfComment(trimmed)
+			continue
+		}
+
+		if trimmed[0] == '[' {
+			if !strings.HasSuffix(trimmed, "]") {
+				return fmt.Errorf("%s:%d: invalid section header", path, n)
+			}
+			name := strings.TrimSpace(trimmed[1:len(trimmed)-1])
+			if _, ok := sections[name]; !ok {
+				sections[name] = make(map[string]string)
+			}
+			section = sections[name]
+			last = ""
+			continue
+		}
+
+		i := strings.IndexAny(trimmed, "=:")
+		if i == -1 || section == nil {
+			return fmt.Errorf("%s:%d: expected <option> = <value>", path, n)
+		}
+		last = strings.ToLower(strings.TrimSpace(trimmed[:i]))
+		section[last] = stripJailConfComment(strings.TrimSpace(trimmed[i+1:]))
+	}
+
+	return scanner.Err()
+}
+
+// Inline comments must be preceded by whitespace, as with fail2ban
+func stripJailConfComment(s string) string {
+	for _, c := range []string{" #", "\t#", " ;", "\t;"} {
+		if i := strings.Index(s, c); i != -1 {
+			s = s[:i]
+		}
+	}
+	return strings.TrimSpace(s)
+}
+
+var interpolation = regexp.MustCompile(`%\(([^)]+)\)s`)
+
+// Substitute %(option)s references
+func interpolate(v string, options map[string]string, depth int) (string, error) {
+	if depth > 10 {
+		return "", fmt.Errorf("interpolation too deep")
+	}
+
+	var err error
+	v = interpolation.ReplaceAllStringFunc(v, func(m string) string {
+		k := strings.ToLower(interpolation.FindStringSubmatch(m)[1])
+		ref, ok := options[k]
+		if !ok {
+			err = fmt.Errorf("undefined reference %s", m)
+			return m
+		}
+		ref, e := interpolate(ref, options, depth + 1)
+		if e != nil {
+			err = e
+		}
+		return ref
+	})
+
+	return v, err
+}
+
+var jailTimeUnits = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([a-z]*)`)
+
+// Parse a fail2ban time, seconds or with suffixes, eg 600, 10m, 1h 30m or 1d
+func ParseJailTime(s string) (int, error) {
+	t := strings.ToLower(strings.TrimSpace(s))
+	if t == "" {
+		return 0, fmt.Errorf("empty time")
+	}
+	if n, err := strconv.Atoi(t); err == nil {
+		return n, nil
+	}
+
+	total := 0.0
+	for t != "" {
+		m := jailTimeUnits.FindStringSubmatch(t)
+		if m == nil {
+			return 0, fmt.Errorf("%q is not a valid time", s)
+		}
+		v, _ := strconv.ParseFloat(m[1], 64)
+
+		var unit float64
+		switch m[2] {
+			case "", "s", "sec", "secs", "second", "seconds", "ss":
+				unit = 1
+			case "m", "mm", "min", "mins", "minute", "minutes":
+				unit = 60
+			case "h", "hh", "hour", "hours":
+				unit = 3600
+			case "d", "dd", "day", "days":
+				unit = 86400
+			case "w", "ww", "wk", "wks", "week", "weeks":
+				unit = 7 * 86400
+			case "mo", "mon", "month", "months":
+				unit = 30.4375 * 86400
+			case "y", "yy", "year", "years":
+				unit = 365.25 * 86400
+			default:
+				return 0, fmt.Errorf("%q is not a valid time", s)
+		}
+		total += v * unit
+
+		t = strings.TrimSpace(t[len(m[0]):])
+	}
+
+	return int(math.Round(total)), nil
+}
+
+func (c JailConf) String() string {
+	s := fmt.Sprintf("jail %s: maxretry=%d findtime=%d bantime=%d", c.Name, c.Policy.MaxRetry, c.Policy.FindTime, c.Policy.BanTime)
+	if c.Policy.AlertOnly {
+		s += " alertonly (not enabled)"
+	}
+	if len(c.IgnoreIp) > 0 {
+		s += " ignoreip=" + strings.Join(c.IgnoreIp, ",")
+	}
+	return s
+}
@@ -2,311 +2,1167 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
-	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 )
 
-func ipToKey(ip net.IP) string {
-	return fmt.Sprintf("aws-fail2ban-%s", ip.String())
+// Every key is prefixed with the namespace, eg so that deployments or jails can share a redis.
+// The default namespace is that of earlier versions, shared by every jail.
+const defaultNamespace = "aws-fail2ban"
+
+// The namespace is templated with the ip set name, and must not affect the hash tags or scan patterns
+func redisNamespace(template, ipsetName string) (string, error) {
+	namespace := strings.ReplaceAll(template, "<jail>", ipsetName)
+	if namespace == "" || strings.ContainsAny(namespace, "{}*?[]\\") {
+		return "", fmt.Errorf("%q is not a valid redis namespace", namespace)
+	}
+	return namespace, nil
+}
+
+func (r *RedisStore) key(name string) string {
+	return r.namespace + "-" + name
+}
+
+// Per ip keys are hash tagged with the ip so that in cluster mode they share a slot, eg for Forget.
+// Ref: https://redis.io/docs/reference/cluster-spec/#hash-tags
+
+// Sorted set of infractions scored by their time (in ms), members are unique per infraction
+func (r *RedisStore) infractionsKey(ip net.IP) string {
+	return r.key(fmt.Sprintf("infractions-{%s}", ip.String()))
+}
+
+func (r *RedisStore) scoreKey(ip net.IP) string {
+	return r.key(fmt.Sprintf("score-{%s}", ip.String()))
+}
+
+func (r *RedisStore) tierKey(ip net.IP) string {
+	return r.key(fmt.Sprintf("tier-{%s}", ip.String()))
+}
+
+// List of the infractions recorded while learning, as unix timestamps
+func (r *RedisStore) learnKey(ip net.IP) string {
+	return r.key(fmt.Sprintf("learn-{%s}", ip.String()))
+}
+
+// Sorted set of reporters of an ip or subnet scored by their latest report (in ms)
+func (r *RedisStore) reportersKey(key string) string {
+	return r.key(fmt.Sprintf("reporters-{%s}", key))
+}
+
+// Keys of earlier versions (in the default namespace), see migrate.
+// Infractions were lists of unix timestamps and the per ip keys were not hash tagged.
+var untaggedKeys = map[string]func(*RedisStore, net.IP) string{
+	"infractions-": (*RedisStore).infractionsKey,
+	      "score-": (*RedisStore).scoreKey,
+	       "tier-": (*RedisStore).tierKey,
+	      "learn-": (*RedisStore).learnKey,
+}
+
+func hashToScore(hash map[string]string) (*Score, error) {
+	score := &Score{}
+	if len(hash) == 0 {
+		return score, nil
+	}
+
+	value, err := strconv.ParseFloat(hash["value"], 64)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := strconv.ParseInt(hash["updated"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	score.Value = value
+	score.Updated = time.Unix(0, updated)
+	score.Banned = hash["banned"] == "1"
+
+	return score, nil
 }
 
-func keyToIp(key string) net.IP {
-	// Possibly nil but should never happen
-	return net.ParseIP(key[len("aws-fail2ban-"):])
+func hashToTier(hash map[string]string) (*Tier, error) {
+	tier := &Tier{}
+	if len(hash) == 0 {
+		return tier, nil
+	}
+
+	var err error
+	if tier.Level, err = strconv.Atoi(hash["level"]); err != nil {
+		return nil, err
+	}
+	if tier.Infractions, err = strconv.Atoi(hash["infractions"]); err != nil {
+		return nil, err
+	}
+	return tier, nil
 }
 
-type ServiceJailer struct {
-	ipset       *IpSet
+// Of the infractions sorted sets, scored by ms
+func zToInfractions(scores []redis.Z) []time.Time {
+	infractions := []time.Time{}
+	for _, z := range scores {
+		infractions = append(infractions, time.Unix(0, int64(z.Score) * int64(time.Millisecond)))
+	}
+	return infractions
+}
 
+func listToInfractions(redisList []string) []time.Time {
+	var rv []time.Time
+	for _, s := range redisList {
+		unixtime, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			ErrorLog("unable to parse time %s", s)
+			continue
+		}
+		t := time.Unix(unixtime, 0)
+
+		rv = append(rv, t)
+	}
+	return rv
+}
+
+// Temporary allowlist entries and manual bans are shared amongst the containers via hashes of cidr to entry.
+// When ips (and manual bans) next need managing is shared via a sorted set by unix timestamp,
+// as are the active automatic bans by when they end.
+const (
+	allowlistKey = "allowlist"
+	bansKey = "bans"
+	dueKey = "due"
+	bannedKey = "banned"
+	migratedKey = "migrated-3" // Bumped as the key scheme changes
+)
+
+// The leader's id, expiring with its lease
+const leaderKey = "leader"
+
+// Stream of json events, see Publish
+const eventsKey = "events"
+
+// The ip set import at startup is claimed (by process id) while importing, renewed like the leader's lease as
+// large ip sets take a while, then marked done for importMarkerTtl so that containers started together (eg by a deploy)
+// import only once. The claim expires importLockTtl after the last renewal should the importer die.
+const (
+	importKey = "import"
+	importLockTtl = 1 * time.Minute
+	importRenewPeriod = 20 * time.Second
+	importMarkerTtl = 10 * time.Minute
+)
+
+// Sliding window counters are sorted sets by millisecond timestamp (see Count).
+// Circuit breaker state, held bans are a hash of ip to unix timestamp.
+const (
+	countPrefix = "count-"
+	trippedKey = "tripped"
+	pendingKey = "pending"
+)
+
+// Learning mode state, the infractions of each ip are lists (see learnKey) and the ips a set.
+// Retained indefinitely so that the recommendations remain available, delete these to learn afresh.
+const (
+	learnStartKey = "learn-start"
+	learnIpsKey = "learn-ips"
+)
+
+type expiringEntry struct {
+	Expiry int64  `json:"expiry"` // Unix timestamp, zero for never
+	Reason string `json:"reason"`
+}
+
+func (e expiringEntry) expiry() time.Time {
+	if e.Expiry == 0 {
+		return time.Time{}
+	}
+	return time.Unix(e.Expiry, 0)
+}
+
+func newExpiringEntry(expiry time.Time, reason string) expiringEntry {
+	entry := expiringEntry{Reason: reason}
+	if !expiry.IsZero() {
+		entry.Expiry = expiry.Unix()
+	}
+	return entry
+}
+
+// Used in service mode to share state amongst the containers
+type RedisStore struct {
 	// Concurrency-safe, ref: https://github.com/go-redis/redis/blob/master/redis.go
-	redisClient *redis.Client
+	redisClient redis.UniversalClient
+	cluster     bool
+	namespace   string
+}
 
-	quitChan    chan bool
+// How to connect to Redis, a single server unless either a sentinel master name or cluster mode is given
+type RedisOptions struct {
+	Addrs      []string // Of the sentinels given a master name, of any of the nodes in cluster mode
+	MasterName string
+	Cluster    bool
+	Username   string   // Redis 6 ACL user, empty for the default user
+	Password   string   // Eg an ElastiCache AUTH token
+	Tls        bool
+	CaPath     string   // PEM bundle of the CAs to verify the servers with (implies Tls), the system's if empty
+	Namespace  string   // Prefix of every key, <jail> is replaced with the ip set name, see defaultNamespace
 }
 
-func NewServiceJailer(ipsetName, redisAddr string) (*ServiceJailer, error) {
-	ipset, err := NewIpSet(ipsetName)
+func newRedisClient(opts RedisOptions) (redis.UniversalClient, error) {
+	if len(opts.Addrs) == 0 {
+		return nil, fmt.Errorf("no redis address")
+	}
+	if opts.Cluster && opts.MasterName != "" {
+		return nil, fmt.Errorf("redis sentinel and cluster modes are exclusive")
+	}
+
+	var tlsConfig *tls.Config
+	if opts.Tls || opts.CaPath != "" {
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+
+		if opts.CaPath != "" {
+			pem, err := ioutil.ReadFile(opts.CaPath)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", opts.CaPath)
+			}
+		}
+	}
+
+	if opts.Cluster {
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			    Addrs: opts.Addrs,
+			 Username: opts.Username,
+			 Password: opts.Password,
+			TLSConfig: tlsConfig,
+		}), nil
+	} else if opts.MasterName != "" {
+		// The sentinels are assumed to share the servers' credentials
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			      MasterName: opts.MasterName,
+			   SentinelAddrs: opts.Addrs,
+			SentinelUsername: opts.Username,
+			SentinelPassword: opts.Password,
+			        Username: opts.Username,
+			        Password: opts.Password,
+			       TLSConfig: tlsConfig,
+		}), nil
+	}
+
+	if len(opts.Addrs) > 1 {
+		return nil, fmt.Errorf("multiple redis addresses require sentinel or cluster mode")
+	}
+	return redis.NewClient(&redis.Options{
+		     Addr: opts.Addrs[0],
+		 Username: opts.Username,
+		 Password: opts.Password,
+		TLSConfig: tlsConfig,
+	}), nil
+}
+
+func NewServiceJailer(ipsetName string, tierNames []string, redisOptions RedisOptions, model string, allowlist *Allowlist, overrides *Overrides, breaker Breaker, hooks *Hooks, learning Learning, subnets []SubnetPolicy) (*Jail, error) {
+	// Escalation tiers with the block tier last
+	ipsets, err := NewIpSets(append(append([]string{}, tierNames...), ipsetName))
+	if err != nil {
+		return nil, err
+	}
+	backends := []Backend{}
+	for _, ipset := range ipsets {
+		backends = append(backends, ipset)
+	}
+
+	namespace, err := redisNamespace(redisOptions.Namespace, ipsetName)
 	if err != nil {
 		return nil, err
 	}
 
-	redisClient := redis.NewClient(&redis.Options{Addr: redisAddr})
+	redisClient, err := newRedisClient(redisOptions)
+	if err != nil {
+		return nil, err
+	}
 	_, err = redisClient.Ping(context.Background()).Result()
 	if err != nil {
 		return nil, err
 	}
 
-	jailer := &ServiceJailer{
-		      ipset: ipset,
-		redisClient: redisClient,
-		   quitChan: make(chan bool),
+	store := &RedisStore{redisClient: redisClient, cluster: redisOptions.Cluster, namespace: namespace}
+	if err := store.migrate(); err != nil {
+		return nil, err
+	}
+
+	jail := NewJail(store, backends, model, allowlist, overrides, breaker, hooks)
+	jail.name = ipsetName
+	jail.subnets = subnets
+	jail.cache = NewBanCache()
+	jail.degraded = NewDegraded(jail, store)
+
+	if err := jail.StartLearning(learning); err != nil {
+		return nil, err
+	}
+
+	if err := jail.syncAllowlist(); err != nil {
+		return nil, err
 	}
 
-	// Sleep a random amount of time should multiple containers be started simultaneously
+	// Unique infraction and count members across containers, see AddInfraction
 	rand.Seed(time.Now().UnixNano())
-	time.Sleep(time.Duration(rand.Intn(60)) * time.Second)
 
-	// Ensure ip set contents are being managed
-	if ips, _, err := ipset.Get(); err != nil {
+	// Only one of the containers started together imports, the others serve immediately
+	if claimed, err := store.claimImport(jail.id); err != nil {
 		return nil, err
-	} else {
-		for _, ip := range ips {
-			llen, err := redisClient.LLen(context.Background(), ipToKey(ip)).Result()
-			if err != nil {
-				ErrorLog(err.Error())
-				continue
+	} else if claimed {
+		stop := store.renewImport(jail.id)
+		for i, ipset := range ipsets {
+			if ipnets, _, err := ipset.Get(); err != nil {
+				stop()
+				store.releaseImport(jail.id)
+				return nil, err
+			} else {
+				jail.Import(i+1, ipnets)
 			}
+		}
+		stop()
 
-			for i:=llen; i<MaxRetry; i++ {
-				if err := jailer.AddInfraction(ip); err != nil {
-					ErrorLog(err.Error())
-				}
-			}
+		if err := store.markImported(jail.id); err != nil {
+			return nil, err
 		}
+		InfoLog("ip sets imported")
+	} else {
+		InfoLog("ip sets import skipped as claimed by another container")
 	}
 
-	go func() {
-		// Use random periods in a crude attempt to avoid overlap with other containers
-		// TODO Ideally want something based on FindTime and BanTime
-		period := time.Duration(rand.Intn(60) + 60) * time.Second
+	jail.Start()
 
-		for {
-			select {
-				case <-jailer.quitChan:
-					break
-				case <-time.After(period):
-					jailer.manageState()
-			}
-		}
-	}()
+	return jail, nil
+}
+
+var leadScript = redis.NewScript(`
+local leader = redis.call("GET", KEYS[1])
+if not leader then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return ARGV[1]
+elseif leader == ARGV[1] then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return leader
+`)
+
+// Delete KEYS[1] only if still ARGV[1], ie as held by the caller
+var resignScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("DEL", KEYS[1])
+end
+return 0
+`)
 
-	return jailer, nil
+func (r *RedisStore) Lead(id string, lease time.Duration) (string, error) {
+	return leadScript.Run(context.Background(), r.redisClient, []string{r.key(leaderKey)}, id, lease.Milliseconds()).Text()
 }
 
-func (j ServiceJailer) Close() error {
-	j.quitChan <- true
+func (r *RedisStore) Resign(id string) error {
+	return resignScript.Run(context.Background(), r.redisClient, []string{r.key(leaderKey)}, id).Err()
+}
 
-	if err := j.redisClient.Close(); err != nil {
+// Trimmed approximately as that is far cheaper
+func (r *RedisStore) Publish(event HookEvent) error {
+	value, err := json.Marshal(event)
+	if err != nil {
 		return err
 	}
 
-	return nil
+	return r.redisClient.XAdd(context.Background(), &redis.XAddArgs{
+		Stream: r.key(eventsKey),
+		MaxLen: eventLimit,
+		Approx: true,
+		Values: []interface{}{"event", value},
+	}).Err()
 }
 
-func (j ServiceJailer) manageState() {
+// The cursor is the stream id of the latest event consumed
+func (r *RedisStore) Events(cursor string, wait time.Duration) ([]HookEvent, string, error) {
 	ctx := context.Background()
+	key := r.key(eventsKey)
 
-	var cursor uint64 = 0
-	var count int64 = 100
+	// Rather than $ so that events published between calls are not missed
+	if cursor == "" {
+		cursor = "0-0"
+		latest, err := r.redisClient.XRevRangeN(ctx, key, "+", "-", 1).Result()
+		if err != nil {
+			return nil, "", err
+		}
+		if len(latest) > 0 {
+			cursor = latest[0].ID
+		}
+	}
 
-	keysEvaluated := 0
-	scanIterations := 0
-	ipsDeleted := 0
-	ipsAffected := 0
-	infractionsDeleted := 0
-	ipsUnbanned := 0
+	streams, err := r.redisClient.XRead(ctx, &redis.XReadArgs{
+		Streams: []string{key, cursor},
+		  Count: eventBuffer,
+		  Block: wait,
+	}).Result()
+	if err == redis.Nil {
+		return []HookEvent{}, cursor, nil
+	} else if err != nil {
+		return nil, "", err
+	}
 
-	listToInfractions := func(redisList []string) []time.Time {
-		var rv []time.Time
-		for _, s := range redisList {
-			unixtime, err := strconv.ParseInt(s, 10, 64)
-			if err != nil {
-				ErrorLog("unable to parse time %s", s)
+	events := []HookEvent{}
+	for _, stream := range streams {
+		for _, message := range stream.Messages {
+			cursor = message.ID
+
+			var event HookEvent
+			value, _ := message.Values["event"].(string)
+			if err := json.Unmarshal([]byte(value), &event); err != nil {
+				ErrorLog("unable to parse event %s: %s", message.ID, err.Error())
 				continue
 			}
-			t := time.Unix(unixtime, 0)
-
-			rv = append(rv, t)
+			events = append(events, event)
 		}
-		return rv
 	}
+	return events, cursor, nil
+}
+
+func (r *RedisStore) claimImport(id string) (bool, error) {
+	return r.redisClient.SetNX(context.Background(), r.key(importKey), "importing " + id, importLockTtl).Result()
+}
+
+// Renew the import claim until stopped (returning once no renewal is in flight),
+// warning should it be lost meanwhile (ie the import stalled for importLockTtl)
+func (r *RedisStore) renewImport(id string) func() {
+	done, stopped := make(chan bool), make(chan bool)
 
-	bannedUntil := func(infractions []time.Time) time.Time {
-		if len(infractions) < MaxRetry {
-			return time.Time{}
+	go func() {
+		defer close(stopped)
+
+		value := "importing " + id
+		for {
+			select {
+				case <-done:
+					return
+				case <-time.After(importRenewPeriod):
+					// The leader's lease script, which also claims afresh should the claim have expired meanwhile
+					holder, err := leadScript.Run(context.Background(), r.redisClient, []string{r.key(importKey)}, value, importLockTtl.Milliseconds()).Text()
+					if err != nil {
+						ErrorLog(err.Error())
+					} else if holder != value {
+						WarningLog("ip sets import claim lost to %q", holder)
+						return
+					}
+			}
 		}
+	}()
 
-		return infractions[len(infractions)-1].Add(BanTime * time.Second)
+	return func() {
+		close(done)
+		<-stopped
 	}
+}
 
-	unban := func(ip net.IP) {
-		ipsUnbanned++
+// Should the import fail, so that a container restarted meanwhile imports
+func (r *RedisStore) releaseImport(id string) {
+	if err := resignScript.Run(context.Background(), r.redisClient, []string{r.key(importKey)}, "importing " + id).Err(); err != nil {
+		ErrorLog(err.Error())
+	}
+}
 
-		InfoLog("%s is unbanned", ip.String())
-		if err := j.Unban(ip); err != nil {
-			ErrorLog(err.Error())
+func (r *RedisStore) markImported(id string) error {
+	value := fmt.Sprintf("imported %s %d", id, time.Now().Unix())
+	return r.redisClient.Set(context.Background(), r.key(importKey), value, importMarkerTtl).Err()
+}
+
+func (r *RedisStore) Ping() error {
+	return r.redisClient.Ping(context.Background()).Err()
+}
+
+// Connection failures and timeouts, or redis not yet serving (eg loading or failing over)
+func (r *RedisStore) Unavailable(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, redis.ErrClosed) {
+		return true
+	}
+
+	s := err.Error()
+	for _, prefix := range []string{"LOADING", "MASTERDOWN", "CLUSTERDOWN", "TRYAGAIN", "READONLY", "redis: connection pool timeout", "redis: all sentinels"} {
+		if strings.HasPrefix(s, prefix) {
+			return true
 		}
 	}
+	return false
+}
+
+func (r *RedisStore) Close() error {
+	return r.redisClient.Close()
+}
 
-	start := time.Now()
+// Records an infraction and retains the latest atomically, mirrors retainInfractions and bannedUntil.
+// Returns the times (in ms) of the infraction preceded by those previously retained.
+var addInfractionScript = redis.NewScript(`
+local key = KEYS[1]
+local member, t, now = ARGV[1], ARGV[2], tonumber(ARGV[3])
+local maxretry, bantime = tonumber(ARGV[4]), tonumber(ARGV[5])
+local alertonly, banable = ARGV[6] == "1", ARGV[7] == "1"
+local ttl = tonumber(ARGV[8])
 
-	for {
-		keys, retCursor, err := j.redisClient.Scan(ctx, cursor, "aws-fail2ban-*", count).Result()
+local infractions = {}
+local scored = redis.call("ZRANGE", key, 0, -1, "WITHSCORES")
+for i = 2, #scored, 2 do
+	table.insert(infractions, scored[i])
+end
+local banned = not alertonly and #infractions >= maxretry and tonumber(infractions[#infractions]) + bantime > now
+
+local retain = maxretry
+if not banable and not banned then
+	retain = maxretry - 1
+end
+
+redis.call("ZADD", key, t, member)
+if retain == 0 then
+	redis.call("DEL", key)
+else
+	redis.call("ZREMRANGEBYRANK", key, 0, -retain - 1)
+	redis.call("PEXPIRE", key, ttl)
+end
+
+table.insert(infractions, t)
+return infractions
+`)
+
+func millisToTimes(millis []string) []time.Time {
+	times := []time.Time{}
+	for _, s := range millis {
+		ms, err := strconv.ParseFloat(s, 64)
 		if err != nil {
-			ErrorLog(err.Error())
+			ErrorLog("unable to parse time %s", s)
+			continue
 		}
+		times = append(times, time.Unix(0, int64(ms) * int64(time.Millisecond)))
+	}
+	return times
+}
 
-		for _, key := range keys {
-			ip := keyToIp(key)
-			if ip == nil {
-				ErrorLog("unable to parse ip from %s", key)
-				continue
-			}
+func boolArg(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
 
-			redisList, err := j.redisClient.LRange(ctx, key, 0, -1).Result()
-			if err != nil {
-				ErrorLog(err.Error())
-				continue
-			}
+func (r *RedisStore) AddInfraction(ip net.IP, t time.Time, policy Policy, banable bool, ttl time.Duration) ([]time.Time, error) {
+	ctx := context.Background()
+	millis := t.UnixNano() / int64(time.Millisecond)
 
-			infractions := listToInfractions(redisList)
-			limit := len(infractions)
+	args := []interface{}{
+		fmt.Sprintf("%d-%d", millis, rand.Int63()),
+		millis,
+		millis,
+		policy.MaxRetry,
+		int64(policy.BanTime) * 1000,
+		boolArg(policy.AlertOnly),
+		boolArg(banable),
+		ttl.Milliseconds(),
+	}
 
-			endtime := bannedUntil(infractions)
-			if !endtime.IsZero() && time.Now().Before(endtime) {
-				limit = len(infractions) - MaxRetry
-				DebugLog("%s banned until %s", ip.String(), endtime.Format("2006-01-02T15:04:05"))
-			}
+	// Run uses EVALSHA, falling back to EVAL should the script not be cached
+	scores, err := addInfractionScript.Run(ctx, r.redisClient, []string{r.infractionsKey(ip)}, args...).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+	infractions := millisToTimes(scores)
 
-			var i int
-			for i = 0; i < limit; i++ {
-				if time.Now().Sub(infractions[i]).Seconds() < FindTime {
-					break
-				}
-			}
-			if i == len(infractions) {
-				if len(infractions) >= MaxRetry {
-					unban(ip)
-				}
+	// The active bans index is only used for lookups hence is maintained separately (and cluster safely) from the script
+	previous := infractions[:len(infractions)-1]
+	retained := infractions
+	if n := len(infractions) - retainInfractions(previous, policy, banable, t); n > 0 {
+		retained = infractions[n:]
+	}
+	if until := bannedUntil(retained, policy); !until.IsZero() {
+		err = r.indexBan(ip, until)
+	}
 
-				if _, err := j.redisClient.Del(ctx, key).Result(); err != nil {
-					ErrorLog(err.Error())
-				}
-				ipsDeleted++
+	return infractions, err
+}
 
-			} else if i > 0 {
-				if len(infractions) >= MaxRetry && len(infractions)-i < MaxRetry {
-					unban(ip)
-				}
+// Add an ip to the active bans index, or remove it given a zero time
+func (r *RedisStore) indexBan(ip net.IP, until time.Time) error {
+	ctx := context.Background()
+	if until.IsZero() {
+		return r.redisClient.ZRem(ctx, r.key(bannedKey), ip.String()).Err()
+	}
+	return r.redisClient.ZAdd(ctx, r.key(bannedKey), &redis.Z{Score: float64(until.Unix()), Member: ip.String()}).Err()
+}
+
+func (r *RedisStore) Infractions(ip net.IP) ([]time.Time, error) {
+	scores, err := r.redisClient.ZRangeWithScores(context.Background(), r.infractionsKey(ip), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	return zToInfractions(scores), nil
+}
+
+func (r *RedisStore) TrimInfractions(ip net.IP, upto time.Time) error {
+	max := strconv.FormatInt(upto.UnixNano() / int64(time.Millisecond), 10)
+	return r.redisClient.ZRemRangeByScore(context.Background(), r.infractionsKey(ip), "-inf", max).Err()
+}
+
+// Convert the legacy infraction lists to sorted sets, once and atomically per key should several containers migrate
+var migrateScript = redis.NewScript(`
+if redis.call("TYPE", KEYS[1]).ok ~= "list" then
+	return 0
+end
+
+local ttl = redis.call("PTTL", KEYS[1])
+for i, t in ipairs(redis.call("LRANGE", KEYS[1], 0, -1)) do
+	redis.call("ZADD", KEYS[2], tonumber(t) * 1000, t .. "-" .. i)
+end
+redis.call("DEL", KEYS[1])
+if ttl > 0 and redis.call("EXISTS", KEYS[2]) == 1 then
+	redis.call("PEXPIRE", KEYS[2], ttl)
+end
+return 1
+`)
+
+// Hash tag an untagged key, should several containers migrate only one renames it
+var renameScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("RENAME", KEYS[1], KEYS[2])
+return 1
+`)
+
+// The one full scan, skipped once recorded as done.
+// Not in cluster mode nor other namespaces as earlier versions did not support them, hence there is nothing to migrate.
+// Reporters keys are not renamed as they expire within FindTime.
+func (r *RedisStore) migrate() error {
+	ctx := context.Background()
+
+	if r.cluster || r.namespace != defaultNamespace {
+		return nil
+	}
+	if done, err := r.redisClient.Exists(ctx, r.key(migratedKey)).Result(); err != nil || done == 1 {
+		return err
+	}
+
+	migrated := 0
+	iter := r.redisClient.Scan(ctx, 0, r.key("*"), 1000).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		name := key[len(r.key("")):]
 
-				if _, err := j.redisClient.LTrim(ctx, key, int64(i), -1).Result(); err != nil {
-					ErrorLog(err.Error())
+		var script *redis.Script
+		var to string
+		if ip := net.ParseIP(name); ip != nil {
+			script, to = migrateScript, r.infractionsKey(ip)
+		} else {
+			for prefix, tagged := range untaggedKeys {
+				if !strings.HasPrefix(name, prefix) {
+					continue
+				}
+				if ip := net.ParseIP(name[len(prefix):]); ip != nil {
+					script, to = renameScript, tagged(r, ip)
 				}
-				ipsAffected++
-				infractionsDeleted += i
 			}
 		}
+		if script == nil {
+			continue
+		}
+
+		n, err := script.Run(ctx, r.redisClient, []string{key, to}).Int()
+		if err != nil {
+			return err
+		}
+		migrated += n
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
 
-		keysEvaluated += len(keys)
-		scanIterations++
+	InfoLog("%d keys of earlier versions migrated", migrated)
+	return r.redisClient.Set(ctx, r.key(migratedKey), time.Now().Unix(), 0).Err()
+}
+
+func (r *RedisStore) UpdateScore(ip net.IP, f func(score *Score) bool) error {
+	ctx := context.Background()
+	key := r.scoreKey(ip)
 
-		if retCursor == 0 {
-			break
+	txf := func(tx *redis.Tx) error {
+		hash, err := tx.HGetAll(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		score, err := hashToScore(hash)
+		if err != nil {
+			return err
 		}
-		cursor = retCursor
 
-		if count < 1000 {
-			count *= 2
+		keep := f(score)
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if !keep {
+				pipe.Del(ctx, key)
+				return nil
+			}
+
+			banned := 0
+			if score.Banned {
+				banned = 1
+			}
+			pipe.HSet(ctx, key, "value", strconv.FormatFloat(score.Value, 'f', -1, 64),
+			                    "updated", score.Updated.UnixNano(), "banned", banned)
+			pipe.ExpireAt(ctx, key, score.DecayedBy(UnbanScore).Add(2 * HalfLife * time.Second))
+			return nil
+		})
+		if err != nil {
+			return err
 		}
-	}
 
-	suffix := func(v int) string {
-		if v == 0 || v > 1 {
-			return "s"
-		} else {
-			return ""
+		// The index is in another slot (in cluster mode) hence updated outside the transaction
+		var until time.Time
+		if keep && score.Banned {
+			until = score.DecayedBy(UnbanScore)
 		}
+		return r.indexBan(ip, until)
 	}
 
-	InfoLog("manageState: %d key%s evaluated in %d scan iteration%s / %s",
-	        keysEvaluated, suffix(keysEvaluated), scanIterations, suffix(scanIterations),
-		time.Since(start).Round(time.Millisecond).String())
+	return r.watch(txf, key, fmt.Sprintf("%s score", ip.String()))
+}
 
-	if ipsUnbanned > 0 {
-		InfoLog("manageState: %d ip%s unbanned", ipsUnbanned, suffix(ipsUnbanned))
-	}
-	if ipsDeleted > 0 {
-		InfoLog("manageState: %d ip%s deleted", ipsDeleted, suffix(ipsDeleted))
+// Optimistically locked read-modify-write of key, retried should there be contention
+func (r *RedisStore) watch(txf func(tx *redis.Tx) error, key, what string) error {
+	limit := 3
+	for n := 0; n < limit; n++ {
+		if err := r.redisClient.Watch(context.Background(), txf, key); err != redis.TxFailedErr {
+			return err
+		}
 	}
-	if ipsAffected > 0 {
-		InfoLog("manageState: %d infractions%s deleted from %d ip%s",
-		        infractionsDeleted, suffix(infractionsDeleted), ipsAffected, suffix(ipsAffected))
+
+	return fmt.Errorf("contention attempting to update %s", what)
+}
+
+// Tiers are hashes of level and infractions, retained for as long as the ip is banned
+func (r *RedisStore) UpdateTier(ip net.IP, f func(tier *Tier) bool) error {
+	ctx := context.Background()
+	key := r.tierKey(ip)
+
+	txf := func(tx *redis.Tx) error {
+		hash, err := tx.HGetAll(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		tier, err := hashToTier(hash)
+		if err != nil {
+			return err
+		}
+
+		keep := f(tier)
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if !keep {
+				pipe.Del(ctx, key)
+				return nil
+			}
+
+			pipe.HSet(ctx, key, "level", tier.Level, "infractions", tier.Infractions)
+			return nil
+		})
+		if err != nil || keep {
+			return err
+		}
+		return r.indexBan(ip, time.Time{})
 	}
+
+	return r.watch(txf, key, fmt.Sprintf("%s tier", ip.String()))
 }
 
-func (j ServiceJailer) AddInfraction(ip net.IP) error {
+func (r *RedisStore) AddReport(key, reporter string, t time.Time, window time.Duration) ([]string, error) {
 	ctx := context.Background()
+	key = r.reportersKey(key)
+	millis := t.UnixNano() / int64(time.Millisecond)
 
-	now := time.Now()
-	llen, err := j.redisClient.RPush(ctx, ipToKey(ip), now.Unix()).Result()
+	var zrange *redis.StringSliceCmd
+	_, err := r.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, key, &redis.Z{Score: float64(millis), Member: reporter})
+		pipe.ZRemRangeByScore(ctx, key, "-inf", strconv.FormatInt(millis - window.Milliseconds(), 10))
+		zrange = pipe.ZRange(ctx, key, 0, -1)
+		pipe.Expire(ctx, key, window)
+		return nil
+	})
 	if err != nil {
+		return nil, err
+	}
+
+	return zrange.Val(), nil
+}
+
+// The ip's keys share a slot hence are deleted at once, the index is in another slot (in cluster mode)
+func (r *RedisStore) Forget(ip net.IP) error {
+	ctx := context.Background()
+	if err := r.redisClient.Del(ctx, r.infractionsKey(ip), r.scoreKey(ip), r.reportersKey(ip.String())).Err(); err != nil {
 		return err
 	}
+	return r.indexBan(ip, time.Time{})
+}
 
-	DebugLog("%s infraction at %s", ip.String(), now.Format("2006-01-02T15:04:05"))
+// Of a cidr only the actively banned ips are found, from the index rather than a full scan
+func (r *RedisStore) IpsWithin(ipnet *net.IPNet) ([]net.IP, error) {
+	if IsSingleCidr(ipnet) {
+		return []net.IP{ipnet.IP}, nil
+	}
 
-	if llen >= MaxRetry {
-		InfoLog("%s banned due to %d infractions", ip.String(), llen)
-		if err := j.Ban(ip); err != nil {
-			return err
-		}
+	members, err := r.redisClient.ZRange(context.Background(), r.key(bannedKey), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
 
-		if llen > MaxRetry {
-			if _, err := j.redisClient.LTrim(ctx, ipToKey(ip), llen-MaxRetry, -1).Result(); err != nil {
-				return err
-			}
+	ips := []net.IP{}
+	for _, member := range members {
+		if ip := net.ParseIP(member); ip != nil && ipnet.Contains(ip) {
+			ips = append(ips, ip)
 		}
 	}
+	return ips, nil
+}
 
-	if _, err := j.redisClient.Expire(ctx, ipToKey(ip), 2 * BanTime * time.Second).Result(); err != nil {
+func (r *RedisStore) setEntry(key string, ipnet *net.IPNet, entry expiringEntry) error {
+	value, err := json.Marshal(entry)
+	if err != nil {
 		return err
 	}
 
+	if _, err := r.redisClient.HSet(context.Background(), key, ipnet.String(), value).Result(); err != nil {
+		return err
+	}
 	return nil
 }
 
-func (j ServiceJailer) Ban(ip net.IP) error {
-	go func() {
-		if err := j.ipset.Add(ip); err != nil {
+func (r *RedisStore) delEntry(key string, ipnet *net.IPNet) error {
+	if _, err := r.redisClient.HDel(context.Background(), key, ipnet.String()).Result(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *RedisStore) entries(key string, f func(ipnet *net.IPNet, entry expiringEntry)) error {
+	hash, err := r.redisClient.HGetAll(context.Background(), key).Result()
+	if err != nil {
+		return err
+	}
+
+	for cidr, value := range hash {
+		ipnet, err := ParseCidr(cidr)
+		if err != nil {
 			ErrorLog(err.Error())
+			continue
 		}
-	}()
+
+		var entry expiringEntry
+		if err := json.Unmarshal([]byte(value), &entry); err != nil {
+			ErrorLog("unable to parse %s entry %s: %s", key, cidr, err.Error())
+			continue
+		}
+
+		f(ipnet, entry)
+	}
+
 	return nil
 }
 
-func (j ServiceJailer) Unban(ip net.IP) error {
-	go func() {
-		if err := j.ipset.Del(ip); err != nil {
+func (r *RedisStore) SetManualBan(ban ManualBan) error {
+	return r.setEntry(r.key(bansKey), ban.IpNet, newExpiringEntry(ban.Expiry, ban.Reason))
+}
+
+func (r *RedisStore) DelManualBan(ipnet *net.IPNet) error {
+	return r.delEntry(r.key(bansKey), ipnet)
+}
+
+func (r *RedisStore) ManualBans() ([]ManualBan, error) {
+	bans := []ManualBan{}
+	err := r.entries(r.key(bansKey), func(ipnet *net.IPNet, entry expiringEntry) {
+		bans = append(bans, ManualBan{IpNet: ipnet, Expiry: entry.expiry(), Reason: entry.Reason})
+	})
+	return bans, err
+}
+
+func (r *RedisStore) SetAllow(entry TemporaryAllow) error {
+	return r.setEntry(r.key(allowlistKey), entry.IpNet, newExpiringEntry(entry.Expiry, entry.Reason))
+}
+
+func (r *RedisStore) DelAllow(ipnet *net.IPNet) error {
+	return r.delEntry(r.key(allowlistKey), ipnet)
+}
+
+func (r *RedisStore) Allows() ([]TemporaryAllow, error) {
+	allows := []TemporaryAllow{}
+	err := r.entries(r.key(allowlistKey), func(ipnet *net.IPNet, entry expiringEntry) {
+		allows = append(allows, TemporaryAllow{IpNet: ipnet, Expiry: entry.expiry(), Reason: entry.Reason})
+	})
+	return allows, err
+}
+
+func (r *RedisStore) Schedule(key string, at time.Time) error {
+	z := &redis.Z{Score: float64(at.Unix()), Member: key}
+	if _, err := r.redisClient.ZAdd(context.Background(), r.key(dueKey), z).Result(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *RedisStore) Unschedule(key string) error {
+	if _, err := r.redisClient.ZRem(context.Background(), r.key(dueKey), key).Result(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *RedisStore) Due(t time.Time) ([]string, error) {
+	ctx := context.Background()
+
+	members, err := r.redisClient.ZRangeByScore(ctx, r.key(dueKey), &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(t.Unix(), 10),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	// Ended automatic bans are dropped from the index here rather than when unbanned
+	if err := r.redisClient.ZRemRangeByScore(ctx, r.key(bannedKey), "-inf", "(" + strconv.FormatInt(t.Unix(), 10)).Err(); err != nil {
+		ErrorLog(err.Error())
+	}
+
+	due := []string{}
+	for _, member := range members {
+		// Only the container that removes the member claims it
+		if n, err := r.redisClient.ZRem(ctx, r.key(dueKey), member).Result(); err != nil {
 			ErrorLog(err.Error())
+		} else if n == 1 {
+			due = append(due, member)
 		}
-	}()
+	}
+
+	return due, nil
+}
+
+// Every tracked ip is scheduled hence the ips are paged through with ZSCAN of the due sorted set,
+// which unlike SCAN is cluster safe. The cursor is ZSCAN's.
+func (r *RedisStore) States(cursor string, count int) ([]IpState, string, error) {
+	ctx := context.Background()
+
+	var c uint64
+	if cursor != "" {
+		var err error
+		if c, err = strconv.ParseUint(cursor, 10, 64); err != nil {
+			return nil, "", fmt.Errorf("%q is not a valid cursor", cursor)
+		}
+	}
+
+	// Members and scores alternate
+	scanned, next, err := r.redisClient.ZScan(ctx, r.key(dueKey), c, "", int64(count)).Result()
+	if err != nil {
+		return nil, "", err
+	}
+	ips := []net.IP{}
+	for i := 0; i < len(scanned); i += 2 {
+		// Skipping manual bans
+		if ip := net.ParseIP(scanned[i]); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+
+	infractions := make([]*redis.ZSliceCmd, len(ips))
+	scores := make([]*redis.StringStringMapCmd, len(ips))
+	tiers := make([]*redis.StringStringMapCmd, len(ips))
+	_, err = r.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, ip := range ips {
+			infractions[i] = pipe.ZRangeWithScores(ctx, r.infractionsKey(ip), 0, -1)
+			scores[i] = pipe.HGetAll(ctx, r.scoreKey(ip))
+			tiers[i] = pipe.HGetAll(ctx, r.tierKey(ip))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	states := []IpState{}
+	for i, ip := range ips {
+		state := IpState{Ip: ip}
+
+		if z := infractions[i].Val(); len(z) > 0 {
+			state.Infractions = zToInfractions(z)
+		}
+		if hash := scores[i].Val(); len(hash) > 0 {
+			if state.Score, err = hashToScore(hash); err != nil {
+				ErrorLog("unable to parse %s score: %s", ip.String(), err.Error())
+				continue
+			}
+		}
+		if hash := tiers[i].Val(); len(hash) > 0 {
+			if state.Tier, err = hashToTier(hash); err != nil {
+				ErrorLog("unable to parse %s tier: %s", ip.String(), err.Error())
+				continue
+			}
+		}
+
+		// Scheduled only to be forgotten
+		if state.Infractions == nil && state.Score == nil {
+			continue
+		}
+		states = append(states, state)
+	}
+
+	cursor = ""
+	if next != 0 {
+		cursor = strconv.FormatUint(next, 10)
+	}
+	return states, cursor, nil
+}
+
+func (r *RedisStore) Count(key string, t time.Time, window time.Duration) (int, error) {
+	ctx := context.Background()
+	key = r.key(countPrefix + key)
+	millis := t.UnixNano() / int64(time.Millisecond)
+
+	var zcard *redis.IntCmd
+	_, err := r.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		// Members must be unique should several containers count simultaneously
+		pipe.ZAdd(ctx, key, &redis.Z{Score: float64(millis), Member: fmt.Sprintf("%d-%d", millis, rand.Int63())})
+		pipe.ZRemRangeByScore(ctx, key, "-inf", strconv.FormatInt(millis - window.Milliseconds(), 10))
+		zcard = pipe.ZCard(ctx, key)
+		pipe.Expire(ctx, key, window)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return int(zcard.Val()), nil
+}
+
+func (r *RedisStore) SetTripped(tripped bool) error {
+	ctx := context.Background()
+
+	var err error
+	if tripped {
+		_, err = r.redisClient.Set(ctx, r.key(trippedKey), time.Now().Unix(), 0).Result()
+	} else {
+		_, err = r.redisClient.Del(ctx, r.key(trippedKey)).Result()
+	}
+	return err
+}
+
+func (r *RedisStore) Tripped() (bool, error) {
+	n, err := r.redisClient.Exists(context.Background(), r.key(trippedKey)).Result()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (r *RedisStore) AddPending(ipnet *net.IPNet, t time.Time) error {
+	if _, err := r.redisClient.HSet(context.Background(), r.key(pendingKey), CidrString(ipnet), t.Unix()).Result(); err != nil {
+		return err
+	}
 	return nil
 }
 
-func (j ServiceJailer) WriteState(w *http.ResponseWriter) error {
-	var err error = nil
-	write := func(s string) {
+func (r *RedisStore) DelPending(ipnet *net.IPNet) (bool, error) {
+	n, err := r.redisClient.HDel(context.Background(), r.key(pendingKey), CidrString(ipnet)).Result()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (r *RedisStore) Pending() ([]PendingBan, error) {
+	hash, err := r.redisClient.HGetAll(context.Background(), r.key(pendingKey)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	pending := []PendingBan{}
+	for s, value := range hash {
+		ipnet, err := ParseCidr(s)
 		if err != nil {
-			return
+			ErrorLog("unable to parse pending ban %s %s", s, value)
+			continue
 		}
-
-		_, err = (*w).Write([]byte(s))
+		unixtime, err := strconv.ParseInt(value, 10, 64)
 		if err != nil {
-			ErrorLog(err.Error())
+			ErrorLog("unable to parse pending ban %s %s", s, value)
+			continue
 		}
+		pending = append(pending, PendingBan{IpNet: ipnet, Held: time.Unix(unixtime, 0)})
 	}
+	return pending, nil
+}
 
-	write("<html><body>\n")
-	write("not implemented, instead refer to:<br/>\n")
-	write("<tt>redis-cli -h &lt;ip&gt; -p &lt;port&gt; --scan --pattern &lt;prefix&gt;-*</tt>\n")
-	write("</body></html>\n")
+func (r *RedisStore) LearningStart(t time.Time) (time.Time, error) {
+	ctx := context.Background()
 
+	if _, err := r.redisClient.SetNX(ctx, r.key(learnStartKey), t.Unix(), 0).Result(); err != nil {
+		return time.Time{}, err
+	}
+
+	unixtime, err := r.redisClient.Get(ctx, r.key(learnStartKey)).Int64()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(unixtime, 0), nil
+}
+
+// Not a transaction as the set is in another slot than the ip's list in cluster mode, an ip briefly
+// recorded without being in the set yet is only considered by the recommendations once it is
+func (r *RedisStore) RecordLearning(ip net.IP, t time.Time) error {
+	ctx := context.Background()
+	key := r.learnKey(ip)
+
+	_, err := r.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(ctx, key, t.Unix())
+		pipe.LTrim(ctx, key, -learnLimit, -1)
+		pipe.SAdd(ctx, r.key(learnIpsKey), ip.String())
+		return nil
+	})
 	return err
 }
 
+func (r *RedisStore) Learnings() (map[string]([]time.Time), error) {
+	ctx := context.Background()
+
+	ips, err := r.redisClient.SMembers(ctx, r.key(learnIpsKey)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	cmds := make(map[string]*redis.StringSliceCmd)
+	_, err = r.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, s := range ips {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				ErrorLog("unable to parse learning ip %s", s)
+				continue
+			}
+			cmds[s] = pipe.LRange(ctx, r.learnKey(ip), 0, -1)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	learnings := make(map[string]([]time.Time))
+	for ip, cmd := range cmds {
+		learnings[ip] = listToInfractions(cmd.Val())
+	}
+	return learnings, nil
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"html"
+	"math"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 )
 
 // Using the fail2ban jail options terminology
@@ -13,13 +18,187 @@ const (
 	BanTime = 1800 // In seconds
 )
 
+// Count model policy, overridable per cidr (see Overrides)
+type Policy struct {
+	MaxRetry  int
+	FindTime  int  // In seconds
+	BanTime   int  // In seconds
+	AlertOnly bool // Never ban, only alert (applies to the score model as well)
+	Quorum    int  // Distinct reporters required within FindTime to ban (applies to the score model as well), zero for any
+}
+
+var DefaultPolicy = Policy{
+	 MaxRetry: MaxRetry,
+	 FindTime: FindTime,
+	  BanTime: BanTime,
+}
+
+// When the ban effected by infractions (in chronological order) ends, zero if not banned
+func bannedUntil(infractions []time.Time, policy Policy) time.Time {
+	if len(infractions) < policy.MaxRetry || policy.AlertOnly {
+		return time.Time{}
+	}
+
+	return infractions[len(infractions)-1].Add(time.Duration(policy.BanTime) * time.Second)
+}
+
+// How many of the latest infractions to retain having recorded one, those relevant to a ban ie MaxRetry.
+// One fewer if the ip was neither banned beforehand nor is banable so that its next infraction is reconsidered.
+// Note that the service mode's Lua script mirrors this.
+func retainInfractions(previous []time.Time, policy Policy, banable bool, now time.Time) int {
+	if banable || bannedUntil(previous, policy).After(now) {
+		return policy.MaxRetry
+	}
+	return policy.MaxRetry - 1
+}
+
+// When infractions next need managing, ie the ban ends or the oldest infraction expires
+func nextDue(infractions []time.Time, policy Policy, now time.Time) time.Time {
+	if endtime := bannedUntil(infractions, policy); endtime.After(now) {
+		return endtime
+	}
+
+	return infractions[0].Add(time.Duration(policy.FindTime) * time.Second)
+}
+
+// Infraction models, ie how infractions are turned into bans
+const (
+	CountModel = "count" // MaxRetry infractions within FindTime, banned for BanTime
+	ScoreModel = "score" // Exponentially decaying score, see below
+)
+
+// Score model parameters, each infraction adds one to an ip's score which halves every HalfLife.
+// A ban is effected once the score reaches BanScore and lifted once it decays below UnbanScore.
+const (
+	HalfLife = 600 // In seconds
+	BanScore = 2.5 // Ie roughly MaxRetry infractions in quick succession
+	UnbanScore = 0.5
+)
+
+type Score struct {
+	Value   float64
+	Updated time.Time
+	Banned  bool
+}
+
+// Decay the score up to t
+func (s *Score) Decay(t time.Time) {
+	if !s.Updated.IsZero() && t.After(s.Updated) {
+		s.Value *= math.Exp2(-t.Sub(s.Updated).Seconds() / HalfLife)
+	}
+	s.Updated = t
+}
+
+// Time at which the score will have decayed below v
+func (s *Score) DecayedBy(v float64) time.Time {
+	if s.Value < v {
+		return s.Updated
+	}
+
+	// The next nanosecond so that the score has indeed decayed below by then
+	secs := HalfLife * math.Log2(s.Value / v)
+	return s.Updated.Add(time.Duration(math.Floor(secs * float64(time.Second))) + 1)
+}
+
+func (s *Score) BannedUntil() time.Time {
+	if !s.Banned || s.Value < UnbanScore {
+		return time.Time{}
+	}
+
+	return s.DecayedBy(UnbanScore)
+}
+
+// Escalation tier of a banned ip, eg a WAF CAPTCHA rule's ip set then a blocking rule's.
+// Levels are one-based up to the block tier, MaxRetry further infractions while in a tier promote to the next.
+type Tier struct {
+	Level       int // Zero if not banned
+	Infractions int // Since reaching the tier
+}
+
+type ManualBan struct {
+	IpNet  *net.IPNet
+	Expiry time.Time // Zero for permanent
+	Reason string
+}
+
+func WriteManualBans(w *http.ResponseWriter, bans []ManualBan) error {
+	table := make(map[string]string)
+	for _, ban := range bans {
+		pretty := "permanent"
+		if !ban.Expiry.IsZero() {
+			pretty = ban.Expiry.Format("until 2006-01-02T15:04:05")
+		}
+		if ban.Reason != "" {
+			pretty += " " + html.EscapeString(ban.Reason)
+		}
+		table[ban.IpNet.String()] = pretty
+	}
+
+	return WriteTable(w, table)
+}
+
+// A page of the infraction state view and its filters
+type StateQuery struct {
+	Cursor string     // Empty for the first page
+	Count  int        // Ips per page (before filtering), zero for all
+	Banned bool       // Only banned ips
+	Within *net.IPNet // Only ips within, nil for any
+	Json   bool
+}
+
+// Query params of the page following cursor
+func (q StateQuery) Next(cursor string) url.Values {
+	params := url.Values{}
+	params.Set("cursor", cursor)
+	if q.Count != 0 {
+		params.Set("count", strconv.Itoa(q.Count))
+	}
+	if q.Banned {
+		params.Set("banned", "1")
+	}
+	if q.Within != nil {
+		params.Set("prefix", q.Within.String())
+	}
+	return params
+}
+
+// Effects bans, eg an AWS WAF ip set
+type Backend interface {
+	Add(ipnet *net.IPNet) error
+	Del(ipnet *net.IPNet) error
+}
+
 type Jailer interface {
-	AddInfraction(ip net.IP) error
+	AddInfraction(ip net.IP, reporter string) error
 
 	Ban(ip net.IP) error
 	Unban(ip net.IP) error
 
-	WriteState(w *http.ResponseWriter) error
+	// Manual bans of ips or cidrs, a zero expiry is permanent
+	BanCidr(ipnet *net.IPNet, expiry time.Time, reason string) error
+	// Lift any ban on and forget the infractions of an ip or cidr
+	Forgive(ipnet *net.IPNet) error
+	WriteBans(w *http.ResponseWriter) error
+
+	// Temporary allowlist entries, a zero expiry never expires
+	Allow(ipnet *net.IPNet, expiry time.Time, reason string) error
+	Disallow(ipnet *net.IPNet) error
+	Allowed(ipnet *net.IPNet) bool
+
+	// Reset a tripped circuit breaker, effecting the held bans unless discarded
+	Resume(discard bool) error
+	WriteBreaker(w *http.ResponseWriter) error
+
+	// Learning mode state and recommendations
+	WriteLearning(w *http.ResponseWriter) error
+
+	WriteState(w *http.ResponseWriter, query StateQuery) error
+	// Leader election amongst the processes sharing the state
+	WriteLeader(w *http.ResponseWriter) error
+	// Events of every process sharing the state from now on until unsubscribed, see EventInfraction
+	Subscribe() (<-chan HookEvent, func())
+	// Whether degraded as the shared state is unavailable, see Degraded
+	Health() Health
 
 	Close() error
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Processes sharing a store elect a leader to manage what is due (unbans and expiries), the others stand by.
+// The leader renews its lease every leaseRenewPeriod, should it fail to for leaseDuration another takes over.
+const (
+	leaseDuration = 15 * time.Second
+	leaseRenewPeriod = 5 * time.Second
+)
+
+// Identifies this process amongst those sharing the store, container hostnames are unique
+func processId() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+func WriteLeader(w *http.ResponseWriter, self, leader string, renewed time.Time) error {
+	table := make(map[string]string)
+
+	table["self"] = self
+	table["leader"] = leader
+	if leader == "" {
+		table["leader"] = "unknown"
+	}
+	table["leading"] = "no"
+	if leader == self {
+		table["leading"] = "yes"
+	}
+	if !renewed.IsZero() {
+		table["lease checked"] = renewed.Format("2006-01-02T15:04:05")
+	}
+
+	return WriteTable(w, table)
+}
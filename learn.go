@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Candidate FindTime values (in seconds) recommendations are made for
+var learnFindTimes = []int{60, 300, 600, 1800, 3600}
+
+// Only the latest infractions of an ip are kept while learning, an ip exceeding this is clearly abusive anyway
+const learnLimit = 1000
+
+// Learning mode, for Period seconds infractions are recorded but nothing is banned.
+// Thereafter MaxRetry values are recommended such that the given percentiles of ips would not have been banned.
+type Learning struct {
+	Period      int // In seconds
+	Percentiles []float64
+}
+
+// Parse comma separated percentiles, eg 95,99
+func ParsePercentiles(s string) ([]float64, error) {
+	percentiles := []float64{}
+	for _, t := range strings.Split(s, ",") {
+		p, err := strconv.ParseFloat(strings.TrimSpace(t), 64)
+		if err != nil || p <= 0 || p >= 100 {
+			return nil, fmt.Errorf("%q is not a valid percentile", t)
+		}
+		percentiles = append(percentiles, p)
+	}
+	return percentiles, nil
+}
+
+type Recommendation struct {
+	Percentile float64
+	FindTime   int // In seconds
+	MaxRetry   int
+	Banned     int // Ips that would have been banned
+}
+
+// Most infractions within any findtime window, infractions are in chronological order
+func peakInfractions(infractions []time.Time, findTime int) int {
+	window := time.Duration(findTime) * time.Second
+
+	peak := 0
+	start := 0
+	for end := range infractions {
+		for infractions[end].Sub(infractions[start]) >= window {
+			start++
+		}
+		if n := end - start + 1; n > peak {
+			peak = n
+		}
+	}
+	return peak
+}
+
+// Recommend for each findtime and percentile the lowest MaxRetry the percentile of ips would not have reached
+func Recommend(learnings map[string]([]time.Time), percentiles []float64) []Recommendation {
+	recommendations := []Recommendation{}
+	if len(learnings) == 0 {
+		return recommendations
+	}
+
+	for _, findTime := range learnFindTimes {
+		peaks := []int{}
+		for _, infractions := range learnings {
+			peaks = append(peaks, peakInfractions(infractions, findTime))
+		}
+		sort.Ints(peaks)
+
+		for _, percentile := range percentiles {
+			i := int(math.Ceil(percentile / 100 * float64(len(peaks)))) - 1
+			if i < 0 {
+				i = 0
+			}
+			maxRetry := peaks[i] + 1
+
+			// Ips whose peak reaches maxRetry, ie those beyond the percentile
+			banned := len(peaks) - sort.SearchInts(peaks, maxRetry)
+
+			recommendations = append(recommendations, Recommendation{
+				Percentile: percentile,
+				  FindTime: findTime,
+				  MaxRetry: maxRetry,
+				    Banned: banned,
+			})
+		}
+	}
+
+	return recommendations
+}
+
+func (r Recommendation) String() string {
+	return fmt.Sprintf("p%g findtime=%d: maxretry=%d (%d ips banned)", r.Percentile, r.FindTime, r.MaxRetry, r.Banned)
+}
+
+func WriteLearning(w *http.ResponseWriter, learning bool, until time.Time, ips int, recommendations []Recommendation) error {
+	table := make(map[string]string)
+
+	if until.IsZero() {
+		table["state"] = "not learning"
+	} else if learning {
+		table["state"] = until.Format("learning until 2006-01-02T15:04:05")
+	} else {
+		table["state"] = until.Format("learnt as of 2006-01-02T15:04:05")
+	}
+	table["ips"] = strconv.Itoa(ips)
+
+	for _, r := range recommendations {
+		table[fmt.Sprintf("p%g findtime=%d", r.Percentile, r.FindTime)] = fmt.Sprintf("maxretry=%d (%d ips banned)", r.MaxRetry, r.Banned)
+	}
+
+	return WriteTable(w, table)
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 )
 
@@ -19,9 +20,102 @@ func main() {
 	flag.IntVar(&port, "port", 8000, "port")
 	flag.IntVar(&port, "p", 8000, "port")
 
+	var model string
+	flag.StringVar(&model, "model", CountModel, "infraction model (count or score)")
+	flag.StringVar(&model, "m", CountModel, "infraction model (count or score)")
+
+	var ignoreIp string
+	flag.StringVar(&ignoreIp, "ignoreip", "", "comma separated ips/cidrs never to ban")
+	flag.StringVar(&ignoreIp, "i", "", "comma separated ips/cidrs never to ban")
+
+	var allowlistPath string
+	flag.StringVar(&allowlistPath, "allowlist", "", "file of ips/cidrs never to ban, reloaded on sighup")
+	flag.StringVar(&allowlistPath, "a", "", "file of ips/cidrs never to ban, reloaded on sighup")
+
+	var overridesPath string
+	flag.StringVar(&overridesPath, "overrides", "", "file of per cidr policy overrides, reloaded on sighup")
+	flag.StringVar(&overridesPath, "o", "", "file of per cidr policy overrides, reloaded on sighup")
+
+	var jailRate string
+	flag.StringVar(&jailRate, "banrate", "", "max automatic bans per window before tripping the circuit breaker, eg 100/60 (unlimited if empty)")
+	flag.StringVar(&jailRate, "b", "", "max automatic bans per window before tripping the circuit breaker, eg 100/60 (unlimited if empty)")
+
+	var globalRate string
+	flag.StringVar(&globalRate, "globalbanrate", "", "as banrate but counting the bans of every jail sharing the state")
+	flag.StringVar(&globalRate, "g", "", "as banrate but counting the bans of every jail sharing the state")
+
+	var learnPeriod int
+	flag.IntVar(&learnPeriod, "learn", 0, "seconds to learn for (without banning) before recommending thresholds")
+	flag.IntVar(&learnPeriod, "L", 0, "seconds to learn for (without banning) before recommending thresholds")
+
+	var percentiles string
+	flag.StringVar(&percentiles, "percentiles", "95,99", "comma separated percentiles of ips not to ban that thresholds are recommended for")
+	flag.StringVar(&percentiles, "P", "95,99", "comma separated percentiles of ips not to ban that thresholds are recommended for")
+
+	var hooksPath string
+	flag.StringVar(&hooksPath, "hooks", "", "file of ban/unban/approach event hooks, reloaded on sighup")
+	flag.StringVar(&hooksPath, "k", "", "file of ban/unban/approach event hooks, reloaded on sighup")
+
+	var tiers string
+	flag.StringVar(&tiers, "tiers", "", "comma separated ip sets escalated through before the block ip set, eg a WAF CAPTCHA rule's")
+	flag.StringVar(&tiers, "e", "", "comma separated ip sets escalated through before the block ip set, eg a WAF CAPTCHA rule's")
+
+	var quorum int
+	flag.IntVar(&quorum, "quorum", 0, "distinct reporters (by address) required within findtime to ban, zero for any")
+	flag.IntVar(&quorum, "q", 0, "distinct reporters (by address) required within findtime to ban, zero for any")
+
+	var subnetPolicies string
+	flag.StringVar(&subnetPolicies, "subnets", "", "comma separated v<4|6>/<bits>:<maxretry> prefixes to also count infractions across and ban, eg v4/24:30,v6/64:50")
+	flag.StringVar(&subnetPolicies, "x", "", "comma separated v<4|6>/<bits>:<maxretry> prefixes to also count infractions across and ban, eg v4/24:30,v6/64:50")
+
+	var jailConfPaths string
+	flag.StringVar(&jailConfPaths, "jailconf", "", "comma separated fail2ban jail.conf/jail.local files to import the jail's policy and ignoreip from")
+	flag.StringVar(&jailConfPaths, "c", "", "comma separated fail2ban jail.conf/jail.local files to import the jail's policy and ignoreip from")
+
+	var jailConfName string
+	flag.StringVar(&jailConfName, "jailname", "", "fail2ban jail to import (default the ip set name)")
+	flag.StringVar(&jailConfName, "n", "", "fail2ban jail to import (default the ip set name)")
+
+	var trustedProxies string
+	flag.StringVar(&trustedProxies, "trustedproxies", "", "comma separated ips/cidrs of proxies (eg the load balancer) whose X-Forwarded-For gives the reporter's address")
+	flag.StringVar(&trustedProxies, "f", "", "comma separated ips/cidrs of proxies (eg the load balancer) whose X-Forwarded-For gives the reporter's address")
+
+	var adminToken string
+	flag.StringVar(&adminToken, "token", os.Getenv("ADMIN_TOKEN"), "admin endpoints bearer token (default $ADMIN_TOKEN)")
+	flag.StringVar(&adminToken, "t", os.Getenv("ADMIN_TOKEN"), "admin endpoints bearer token (default $ADMIN_TOKEN)")
+
 	var redis string
-	flag.StringVar(&redis, "redis", "127.0.0.1:6379", "redis address:port")
-	flag.StringVar(&redis, "r", "127.0.0.1:6379", "redis address:port")
+	flag.StringVar(&redis, "redis", "127.0.0.1:6379", "comma separated redis address:port, of the sentinels or cluster nodes if several")
+	flag.StringVar(&redis, "r", "127.0.0.1:6379", "comma separated redis address:port, of the sentinels or cluster nodes if several")
+
+	var redisNamespace string
+	flag.StringVar(&redisNamespace, "namespace", defaultNamespace, "prefix of the redis keys, <jail> is replaced with the ip set name, eg prod-<jail>")
+	flag.StringVar(&redisNamespace, "N", defaultNamespace, "prefix of the redis keys, <jail> is replaced with the ip set name, eg prod-<jail>")
+
+	var redisMaster string
+	flag.StringVar(&redisMaster, "redismaster", "", "redis sentinel master name (sentinel mode if set)")
+	flag.StringVar(&redisMaster, "M", "", "redis sentinel master name (sentinel mode if set)")
+
+	var redisCluster bool
+	flag.BoolVar(&redisCluster, "rediscluster", false, "redis cluster mode")
+	flag.BoolVar(&redisCluster, "C", false, "redis cluster mode")
+
+	var redisUser string
+	flag.StringVar(&redisUser, "redisuser", os.Getenv("REDIS_USERNAME"), "redis ACL username (default $REDIS_USERNAME)")
+	flag.StringVar(&redisUser, "u", os.Getenv("REDIS_USERNAME"), "redis ACL username (default $REDIS_USERNAME)")
+
+	// Preferably given by the environment so as not to be visible in the process list
+	var redisPassword string
+	flag.StringVar(&redisPassword, "redispassword", os.Getenv("REDIS_PASSWORD"), "redis password or AUTH token (default $REDIS_PASSWORD)")
+	flag.StringVar(&redisPassword, "w", os.Getenv("REDIS_PASSWORD"), "redis password or AUTH token (default $REDIS_PASSWORD)")
+
+	var redisTls bool
+	flag.BoolVar(&redisTls, "redistls", false, "connect to redis with tls")
+	flag.BoolVar(&redisTls, "T", false, "connect to redis with tls")
+
+	var redisCa string
+	flag.StringVar(&redisCa, "redisca", "", "PEM file of the CAs to verify redis with, implies redistls (default the system's)")
+	flag.StringVar(&redisCa, "A", "", "PEM file of the CAs to verify redis with, implies redistls (default the system's)")
 
 	flag.Parse()
 
@@ -31,9 +125,115 @@ func main() {
 	}
 	ipset := flag.Args()[0]
 
+	if model != CountModel && model != ScoreModel {
+		fmt.Fprintf(os.Stderr, "unsupported model %q\n", model)
+		os.Exit(1)
+	}
+
+	jailBanRate, err := ParseBanRate(jailRate)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+	globalBanRate, err := ParseBanRate(globalRate)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+	breaker := Breaker{Jail: jailBanRate, Global: globalBanRate}
+
+	if quorum < 0 {
+		fmt.Fprintf(os.Stderr, "invalid quorum %d\n", quorum)
+		os.Exit(1)
+	}
+
+	proxies, err := ParseCidrs(trustedProxies)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	subnets, err := ParseSubnets(subnetPolicies)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if learnPeriod < 0 {
+		fmt.Fprintf(os.Stderr, "invalid learning period %d\n", learnPeriod)
+		os.Exit(1)
+	}
+	learnPercentiles, err := ParsePercentiles(percentiles)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+	learning := Learning{Period: learnPeriod, Percentiles: learnPercentiles}
+
+	tierNames := []string{}
+	if tiers != "" {
+		tierNames = strings.Split(tiers, ",")
+	}
+
 	DefaultLogger.Level = logLevel
 
-	jailer, err := NewServiceJailer(ipset, redis)
+	cidrs := []string{}
+	if ignoreIp != "" {
+		cidrs = strings.Split(ignoreIp, ",")
+	}
+
+	// Explicit options take precedence over the imported ones
+	base := DefaultPolicy
+	if jailConfPaths != "" {
+		if jailConfName == "" {
+			jailConfName = ipset
+		}
+		conf, err := ParseJailConf(strings.Split(jailConfPaths, ","), jailConfName)
+		if err != nil {
+			PanicLog(err.Error())
+		}
+		for _, option := range conf.Unsupported {
+			WarningLog("jailconf: unsupported %s", option)
+		}
+		InfoLog("jailconf: imported %s", conf.String())
+
+		base = conf.Policy
+		cidrs = append(cidrs, conf.IgnoreIp...)
+	}
+	base.Quorum = quorum
+
+	// Containers typically reach the jailer through a load balancer, the reports would then all share its address
+	if quorum > 1 && len(proxies) == 0 {
+		WarningLog("quorum of %d reporters counted by their address as seen directly, see -trustedproxies if behind a load balancer", quorum)
+	}
+
+	allowlist, err := NewAllowlist(cidrs, allowlistPath)
+	if err != nil {
+		PanicLog(err.Error())
+	}
+
+	overrides, err := NewOverrides(overridesPath, base)
+	if err != nil {
+		PanicLog(err.Error())
+	}
+
+	hooks, err := NewHooks(hooksPath, ipset)
+	if err != nil {
+		PanicLog(err.Error())
+	}
+
+	redisOptions := RedisOptions{
+		     Addrs: strings.Split(redis, ","),
+		MasterName: redisMaster,
+		   Cluster: redisCluster,
+		  Username: redisUser,
+		  Password: redisPassword,
+		       Tls: redisTls,
+		    CaPath: redisCa,
+		 Namespace: redisNamespace,
+	}
+
+	jailer, err := NewServiceJailer(ipset, tierNames, redisOptions, model, allowlist, overrides, breaker, hooks, learning, subnets)
 	if err != nil {
 		PanicLog(err.Error())
 	}
@@ -43,7 +243,7 @@ func main() {
 		}
 	}()
 
-	handler, err := NewHandler(*jailer)
+	handler, err := NewHandler(jailer, allowlist, hooks, adminToken, proxies)
 	if err != nil {
 		PanicLog(err.Error())
 	}
@@ -58,9 +258,16 @@ func main() {
 	// AWS ECS health check handler
 	http.Handle("/", handler)
 
+	if adminToken != "" {
+		http.Handle("/admin/", handler)
+	}
+
 	if logLevel <= 1 {
 		http.Handle("/state/infractions", handler)
 		http.Handle("/state/requests", handler)
+		http.Handle("/state/leader", handler)
+		http.Handle("/state/health", handler)
+		http.Handle("/state/events", handler)
 	}
 
 	InfoLog("listening on port %d", port)
@@ -78,6 +285,24 @@ func main() {
 		server.Close()
 	}()
 
+	hupchan := make(chan os.Signal, 1)
+	signal.Notify(hupchan, syscall.SIGHUP)
+
+	go func() {
+		for range hupchan {
+			InfoLog("reloading allowlist, overrides and hooks")
+			if err := allowlist.Reload(); err != nil {
+				ErrorLog(err.Error())
+			}
+			if err := overrides.Reload(); err != nil {
+				ErrorLog(err.Error())
+			}
+			if err := hooks.Reload(); err != nil {
+				ErrorLog(err.Error())
+			}
+		}
+	}()
+
 	if err := server.ListenAndServe(); err != nil {
 		if err != http.ErrServerClosed {
 			PanicLog(err.Error())
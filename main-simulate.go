@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func main() {
+	var logLevel int
+	flag.IntVar(&logLevel, "loglevel", WarningLevel, "log level")
+	flag.IntVar(&logLevel, "l", WarningLevel, "log level")
+
+	var jailName string
+	flag.StringVar(&jailName, "jail", "", "only replay the infractions of this jail (all if empty)")
+	flag.StringVar(&jailName, "j", "", "only replay the infractions of this jail (all if empty)")
+
+	var ignoreIp string
+	flag.StringVar(&ignoreIp, "ignoreip", "", "comma separated ips/cidrs never to ban")
+	flag.StringVar(&ignoreIp, "i", "", "comma separated ips/cidrs never to ban")
+
+	var allowlistPath string
+	flag.StringVar(&allowlistPath, "allowlist", "", "file of ips/cidrs never to ban")
+	flag.StringVar(&allowlistPath, "a", "", "file of ips/cidrs never to ban")
+
+	flag.Parse()
+
+	if len(flag.Args()) < 2 {
+		fmt.Fprintf(os.Stderr, "usage: main-simulate [opts] <infractions.jsonl> <candidate>...\n")
+		fmt.Fprintf(os.Stderr, "candidates are eg \"maxretry=5 findtime=300 bantime=3600\" or \"score\"\n")
+		os.Exit(1)
+	}
+
+	candidates := []Candidate{}
+	for _, s := range flag.Args()[1:] {
+		candidate, err := ParseCandidate(s)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	DefaultLogger.Level = logLevel
+
+	cidrs := []string{}
+	if ignoreIp != "" {
+		cidrs = strings.Split(ignoreIp, ",")
+	}
+	allowlist, err := NewAllowlist(cidrs, allowlistPath)
+	if err != nil {
+		PanicLog(err.Error())
+	}
+
+	file, err := os.Open(flag.Args()[0])
+	if err != nil {
+		PanicLog(err.Error())
+	}
+	defer file.Close()
+
+	jails := make(map[string]([]SimRecord))
+
+	line := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		var record SimRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			PanicLog("unable to parse line %d: %s", line, err.Error())
+		}
+		if jailName != "" && record.Jail != jailName {
+			continue
+		}
+		jails[record.Jail] = append(jails[record.Jail], record)
+	}
+	if err := scanner.Err(); err != nil {
+		PanicLog(err.Error())
+	}
+
+	names := []string{}
+	for name, records := range jails {
+		names = append(names, name)
+		sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	}
+	sort.Strings(names)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "jail\tcandidate\tinfractions\tips\tbanned ips\tbans\tmean ban\tlongest ban\tpeak ip set size\tpeak at\n")
+
+	for _, name := range names {
+		for _, candidate := range candidates {
+			report, err := Simulate(jails[name], candidate, allowlist)
+			if err != nil {
+				PanicLog("%s %s: %s", name, candidate.Name, err.Error())
+			}
+
+			peakTime := "-"
+			if !report.PeakTime.IsZero() {
+				peakTime = report.PeakTime.Format("2006-01-02T15:04:05")
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%s\t%s\t%d\t%s\n",
+			            name, candidate.Name, report.Infractions, report.Ips, report.Banned, report.Bans,
+			            report.MeanBan().Round(time.Second).String(), report.LongestBan.Round(time.Second).String(), report.PeakSize, peakTime)
+		}
+	}
+
+	w.Flush()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Per cidr overrides of the default policy, eg for clients behind large NATs.
+// Read from a file with one override per line, eg:
+//   203.0.113.0/24 maxretry=20 findtime=300
+//   198.51.100.7 alertonly
+//   192.0.2.0/24 quorum=2
+type Overrides struct {
+	path    string
+	base    Policy // Of ips not overridden
+
+
+	mux     sync.Mutex
+	entries []override
+}
+
+type override struct {
+	ipnet  *net.IPNet
+	policy Policy
+}
+
+// Overrides apply on top of the base policy, ie DefaultPolicy unless imported (see JailConf)
+func NewOverrides(path string, base Policy) (*Overrides, error) {
+	overrides := &Overrides{path: path, base: base}
+
+	if err := overrides.Reload(); err != nil {
+		return nil, err
+	}
+
+	return overrides, nil
+}
+
+func parseOverride(line string, base Policy) (override, error) {
+	fields := strings.Fields(line)
+
+	ipnet, err := ParseCidr(fields[0])
+	if err != nil {
+		return override{}, err
+	}
+
+	policy, err := ParsePolicy(fields[1:], base)
+	if err != nil {
+		return override{}, fmt.Errorf("%s for %s", err.Error(), fields[0])
+	}
+
+	return override{ipnet: ipnet, policy: policy}, nil
+}
+
+// Apply fields of the form maxretry=N, findtime=secs, bantime=secs, quorum=N or alertonly to a policy
+func ParsePolicy(fields []string, policy Policy) (Policy, error) {
+	for _, field := range fields {
+		if field == "alertonly" {
+			policy.AlertOnly = true
+			continue
+		}
+
+		t := strings.SplitN(field, "=", 2)
+		if len(t) != 2 {
+			return Policy{}, fmt.Errorf("unexpected override %q", field)
+		}
+
+		v, err := strconv.Atoi(t[1])
+		if err != nil || v <= 0 {
+			return Policy{}, fmt.Errorf("invalid %s value %q", t[0], t[1])
+		}
+
+		switch t[0] {
+			case "maxretry":
+				policy.MaxRetry = v
+			case "findtime":
+				policy.FindTime = v
+			case "bantime":
+				policy.BanTime = v
+			case "quorum":
+				policy.Quorum = v
+			default:
+				return Policy{}, fmt.Errorf("unsupported override %q", t[0])
+		}
+	}
+
+	return policy, nil
+}
+
+func (o *Overrides) Reload() error {
+	if o.path == "" {
+		return nil
+	}
+
+	file, err := os.Open(o.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	entries := []override{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		entry, err := parseOverride(line, o.base)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	o.entries = entries
+	InfoLog("overrides: %d entries loaded", len(entries))
+
+	return nil
+}
+
+// Policy of the most specific cidr containing ip or the base policy
+func (o *Overrides) Policy(ip net.IP) Policy {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	policy := o.base
+	best := -1
+	for _, entry := range o.entries {
+		if !entry.ipnet.Contains(ip) {
+			continue
+		}
+		if ones, _ := entry.ipnet.Mask.Size(); ones > best {
+			policy = entry.policy
+			best = ones
+		}
+	}
+
+	return policy
+}
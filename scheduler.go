@@ -0,0 +1,81 @@
+package main
+
+import (
+	"container/heap"
+	"time"
+)
+
+// Min-heap of keys by the time they are next due.
+// Rescheduling a key replaces its previous time, callers are expected to recheck their state when due.
+// Not concurrency-safe, the owner is expected to provide locking.
+type Scheduler struct {
+	entries scheduleHeap
+	pending map[string]time.Time // Current time by key, heap entries not matching are stale
+}
+
+type scheduleEntry struct {
+	key string
+	at  time.Time
+}
+
+// Ref: https://pkg.go.dev/container/heap
+type scheduleHeap []scheduleEntry
+
+func (h scheduleHeap) Len() int           { return len(h) }
+func (h scheduleHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+func (h scheduleHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *scheduleHeap) Push(x interface{}) {
+	*h = append(*h, x.(scheduleEntry))
+}
+
+func (h *scheduleHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+func NewScheduler() *Scheduler {
+	return &Scheduler{pending: make(map[string]time.Time)}
+}
+
+func (s *Scheduler) Schedule(key string, at time.Time) {
+	if t, ok := s.pending[key]; ok && t.Equal(at) {
+		return
+	}
+	s.pending[key] = at
+	heap.Push(&s.entries, scheduleEntry{key: key, at: at})
+}
+
+func (s *Scheduler) Cancel(key string) {
+	delete(s.pending, key)
+}
+
+// Remove and return the keys due by t
+func (s *Scheduler) Due(t time.Time) []string {
+	due := []string{}
+
+	for len(s.entries) > 0 && !s.entries[0].at.After(t) {
+		entry := heap.Pop(&s.entries).(scheduleEntry)
+		if at, ok := s.pending[entry.key]; !ok || !at.Equal(entry.at) {
+			continue
+		}
+		delete(s.pending, entry.key)
+		due = append(due, entry.key)
+	}
+
+	return due
+}
+
+// Time of the earliest entry, zero if none
+func (s *Scheduler) Next() time.Time {
+	for len(s.entries) > 0 {
+		entry := s.entries[0]
+		if at, ok := s.pending[entry.key]; ok && at.Equal(entry.at) {
+			return entry.at
+		}
+		heap.Pop(&s.entries)
+	}
+	return time.Time{}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// A recorded infraction, read as JSON lines, eg:
+//   {"ip": "192.0.2.1", "time": "2021-03-01T12:00:00Z", "jail": "my-ip-set", "reporter": "10.0.0.5"}
+type SimRecord struct {
+	Ip       string    `json:"ip"`
+	Time     time.Time `json:"time"`
+	Jail     string    `json:"jail"`
+	Reporter string    `json:"reporter,omitempty"`
+}
+
+// A candidate model and policy, eg "maxretry=5 findtime=300" or "score"
+type Candidate struct {
+	Name   string
+	Model  string
+	Policy Policy
+}
+
+func ParseCandidate(s string) (Candidate, error) {
+	candidate := Candidate{Name: s, Model: CountModel}
+
+	fields := strings.Fields(s)
+	if len(fields) > 0 && (fields[0] == CountModel || fields[0] == ScoreModel) {
+		candidate.Model = fields[0]
+		fields = fields[1:]
+	}
+
+	policy, err := ParsePolicy(fields, DefaultPolicy)
+	if err != nil {
+		return Candidate{}, fmt.Errorf("%s for candidate %q", err.Error(), s)
+	}
+	candidate.Policy = policy
+
+	return candidate, nil
+}
+
+type SimReport struct {
+	Jail        string
+	Candidate   string
+
+	Infractions int
+	Ips         int           // Distinct offending ips
+	Banned      int           // Distinct ips banned
+	Bans        int
+	BanTime     time.Duration // Total of all bans
+	LongestBan  time.Duration
+
+	PeakSize    int           // Of the ip set
+	PeakTime    time.Time
+}
+
+func (r SimReport) MeanBan() time.Duration {
+	if r.Bans == 0 {
+		return 0
+	}
+	return r.BanTime / time.Duration(r.Bans)
+}
+
+// Records the ip set changes (in virtual time) instead of effecting them
+type simBackend struct {
+	now    func() time.Time
+	set    map[string]time.Time // Ban start by cidr
+	banned map[string]bool
+	report *SimReport
+}
+
+func (s *simBackend) Add(ipnet *net.IPNet) error {
+	key := ipnet.String()
+	if _, ok := s.set[key]; ok {
+		return nil
+	}
+
+	s.set[key] = s.now()
+	s.banned[key] = true
+	s.report.Bans++
+
+	if len(s.set) > s.report.PeakSize {
+		s.report.PeakSize = len(s.set)
+		s.report.PeakTime = s.now()
+	}
+	return nil
+}
+
+func (s *simBackend) Del(ipnet *net.IPNet) error {
+	key := ipnet.String()
+	start, ok := s.set[key]
+	if !ok {
+		return nil
+	}
+	delete(s.set, key)
+
+	duration := s.now().Sub(start)
+	s.report.BanTime += duration
+	if duration > s.report.LongestBan {
+		s.report.LongestBan = duration
+	}
+	return nil
+}
+
+// Replay the records (in chronological order) of a single jail through the jail engine with a virtual clock.
+// Every ban is run to completion so that the ban durations are known.
+func Simulate(records []SimRecord, candidate Candidate, allowlist *Allowlist) (SimReport, error) {
+	var clock time.Time
+	now := func() time.Time { return clock }
+
+	report := SimReport{Candidate: candidate.Name}
+	backend := &simBackend{
+		   now: now,
+		   set: make(map[string]time.Time),
+		banned: make(map[string]bool),
+		report: &report,
+	}
+
+	store := NewMemoryStore()
+	overrides := &Overrides{base: candidate.Policy}
+
+	jail := NewJail(store, []Backend{backend}, candidate.Model, allowlist, overrides, Breaker{}, nil)
+	jail.now = now
+	jail.simulated = true
+
+	// Advance the virtual clock through whatever is due up to t
+	advance := func(t time.Time) {
+		for next := store.Next(); !next.IsZero() && !next.After(t); next = store.Next() {
+			clock = next
+			jail.manageDue(next)
+		}
+		clock = t
+	}
+
+	ips := make(map[string]bool)
+	for _, record := range records {
+		ip := net.ParseIP(record.Ip)
+		if ip == nil {
+			return report, fmt.Errorf("%q is not a valid ip", record.Ip)
+		}
+		if record.Time.Before(clock) {
+			return report, fmt.Errorf("%s infraction at %s out of order", record.Ip, record.Time.Format("2006-01-02T15:04:05"))
+		}
+
+		advance(record.Time)
+
+		ips[ip.String()] = true
+		report.Infractions++
+		if err := jail.AddInfraction(ip, record.Reporter); err != nil {
+			return report, err
+		}
+	}
+
+	for next := store.Next(); !next.IsZero(); next = store.Next() {
+		advance(next)
+	}
+
+	report.Ips = len(ips)
+	report.Banned = len(backend.banned)
+
+	return report, nil
+}
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Snapshot after this many log records
+const snapshotRecords = 10000
+
+// A MemoryStore persisted to disk as an append-only log of mutations with periodic snapshots.
+// State is recovered at startup by loading the snapshot (<path>.snapshot) and replaying the log (<path>.log).
+type FileStore struct {
+	*MemoryStore
+
+	path    string
+
+	mux     sync.Mutex // Held across each mutation and its log record so the log order is the memory order
+	log     *os.File
+	records int
+}
+
+type logRecord struct {
+	Op       string    `json:"op"`
+	Ip       string    `json:"ip,omitempty"`
+	Time     time.Time `json:"time,omitempty"`
+	N        int       `json:"n,omitempty"`
+	Score    *Score    `json:"score,omitempty"`
+	Tier     *Tier     `json:"tier,omitempty"`
+	Cidr     string    `json:"cidr,omitempty"`
+	Expiry   time.Time `json:"expiry,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Key      string    `json:"key,omitempty"`
+	Flag     bool      `json:"flag,omitempty"`
+	Reporter string    `json:"reporter,omitempty"`
+}
+
+type snapshotEntry struct {
+	Cidr   string    `json:"cidr"`
+	Expiry time.Time `json:"expiry"`
+	Reason string    `json:"reason"`
+}
+
+type snapshot struct {
+	Infractions map[string]([]time.Time)          `json:"infractions"`
+	Scores      map[string](*Score)               `json:"scores"`
+	Tiers       map[string]Tier                   `json:"tiers"`
+	Reports     map[string](map[string]time.Time) `json:"reports"`
+	Expiries    map[string]time.Time              `json:"expiries"`
+	Bans        []snapshotEntry                   `json:"bans"`
+	Allows      []snapshotEntry                   `json:"allows"`
+	Schedule    map[string]time.Time              `json:"schedule"`
+	Tripped     bool                              `json:"tripped"`
+	Pending     map[string]time.Time              `json:"pending"`
+	LearnStart  time.Time                         `json:"learnstart"`
+	Learnings   map[string]([]time.Time)          `json:"learnings"`
+}
+
+func NewFileStore(path string) (*FileStore, error) {
+	store := &FileStore{
+		MemoryStore: NewMemoryStore(),
+		       path: path,
+	}
+
+	if err := store.recover(); err != nil {
+		return nil, err
+	}
+
+	// Start afresh from a snapshot of the recovered state
+	if err := store.snapshot(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (f *FileStore) recover() error {
+	start := time.Now()
+
+	if data, err := os.ReadFile(f.path + ".snapshot"); err == nil {
+		var snap snapshot
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return fmt.Errorf("unable to parse %s.snapshot: %s", f.path, err.Error())
+		}
+
+		if snap.Infractions != nil {
+			f.MemoryStore.infractions = snap.Infractions
+		}
+		if snap.Scores != nil {
+			f.MemoryStore.scores = snap.Scores
+		}
+		if snap.Tiers != nil {
+			f.MemoryStore.tiers = snap.Tiers
+		}
+		if snap.Reports != nil {
+			f.MemoryStore.reports = snap.Reports
+		}
+		if snap.Expiries != nil {
+			f.MemoryStore.expiries = snap.Expiries
+		}
+		// Snapshots predating the expiries, their reports assumed to be within the default find time
+		for key, reporters := range f.MemoryStore.reports {
+			if _, ok := f.MemoryStore.expiries[key]; ok {
+				continue
+			}
+			for _, latest := range reporters {
+				f.MemoryStore.extend(key, latest.Add(time.Duration(DefaultPolicy.FindTime) * time.Second))
+			}
+		}
+		for _, entry := range snap.Bans {
+			f.apply(logRecord{Op: "ban", Cidr: entry.Cidr, Expiry: entry.Expiry, Reason: entry.Reason})
+		}
+		for _, entry := range snap.Allows {
+			f.apply(logRecord{Op: "allow", Cidr: entry.Cidr, Expiry: entry.Expiry, Reason: entry.Reason})
+		}
+		for key, at := range snap.Schedule {
+			f.MemoryStore.scheduler.Schedule(key, at)
+		}
+		f.MemoryStore.tripped = snap.Tripped
+		if snap.Pending != nil {
+			f.MemoryStore.pending = snap.Pending
+		}
+		f.MemoryStore.learnStart = snap.LearnStart
+		if snap.Learnings != nil {
+			f.MemoryStore.learnings = snap.Learnings
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	file, err := os.Open(f.path + ".log")
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	records := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record logRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// Most likely a partially written final record
+			WarningLog("unable to parse %s.log record %d: %s", f.path, records+1, err.Error())
+			break
+		}
+		f.apply(record)
+		records++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	InfoLog("recovered %d ips, %d log records replayed / %s",
+	        len(f.MemoryStore.infractions) + len(f.MemoryStore.scores), records,
+	        time.Since(start).Round(time.Millisecond).String())
+
+	return nil
+}
+
+// Replay a record against the underlying MemoryStore
+func (f *FileStore) apply(record logRecord) {
+	ip := net.ParseIP(record.Ip)
+	if record.Ip != "" && ip == nil {
+		ErrorLog("unable to parse ip %s", record.Ip)
+		return
+	}
+
+	var ipnet *net.IPNet
+	if record.Cidr != "" {
+		var err error
+		if ipnet, err = ParseCidr(record.Cidr); err != nil {
+			ErrorLog(err.Error())
+			return
+		}
+	}
+
+	m := f.MemoryStore
+	switch record.Op {
+		case "infraction":
+			m.replayInfraction(ip, record.Time)
+		case "trim":
+			m.replayTrim(ip, record.N)
+		case "score":
+			m.UpdateScore(ip, func(score *Score) bool {
+				if record.Score == nil {
+					return false
+				}
+				*score = *record.Score
+				return true
+			})
+		case "tier":
+			m.UpdateTier(ip, func(tier *Tier) bool {
+				if record.Tier == nil {
+					return false
+				}
+				*tier = *record.Tier
+				return true
+			})
+		case "report":
+			m.AddReport(record.Key, record.Reporter, record.Time, time.Duration(record.N) * time.Second)
+		case "forget":
+			m.Forget(ip)
+		case "ban":
+			m.SetManualBan(ManualBan{IpNet: ipnet, Expiry: record.Expiry, Reason: record.Reason})
+		case "unban":
+			m.DelManualBan(ipnet)
+		case "allow":
+			m.SetAllow(TemporaryAllow{IpNet: ipnet, Expiry: record.Expiry, Reason: record.Reason})
+		case "disallow":
+			m.DelAllow(ipnet)
+		case "schedule":
+			m.Schedule(record.Key, record.Time)
+		case "unschedule":
+			m.Unschedule(record.Key)
+		case "tripped":
+			m.SetTripped(record.Flag)
+		// Ips were recorded as such before subnets could be pending
+		case "pending":
+			if ipnet == nil {
+				ipnet = SingleCidr(ip)
+			}
+			m.AddPending(ipnet, record.Time)
+		case "unpending":
+			if ipnet == nil {
+				ipnet = SingleCidr(ip)
+			}
+			m.DelPending(ipnet)
+		case "learnstart":
+			m.LearningStart(record.Time)
+		case "learn":
+			m.RecordLearning(ip, record.Time)
+		default:
+			ErrorLog("unknown log record op %q", record.Op)
+	}
+}
+
+// The log records the infractions recorded and trimmed as such, unlike AddInfraction and TrimInfractions
+func (m *MemoryStore) replayInfraction(ip net.IP, t time.Time) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.infractions[ip.String()] = append(m.infractions[ip.String()], t)
+}
+
+func (m *MemoryStore) replayTrim(ip net.IP, n int) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.trim(ip.String(), n)
+}
+
+// Expects mux to be held
+func (f *FileStore) append(record logRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.log.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	f.records++
+	if f.records >= snapshotRecords {
+		return f.snapshot()
+	}
+	return nil
+}
+
+// Expects mux to be held (or to not yet be needed), replaces the log with a snapshot of the current state
+func (f *FileStore) snapshot() error {
+	m := f.MemoryStore
+	m.mux.Lock()
+
+	snap := snapshot{
+		Infractions: m.infractions,
+		     Scores: m.scores,
+		      Tiers: m.tiers,
+		    Reports: m.reports,
+		   Expiries: m.expiries,
+		       Bans: []snapshotEntry{},
+		     Allows: []snapshotEntry{},
+		   Schedule: m.scheduler.pending,
+		    Tripped: m.tripped,
+		    Pending: m.pending,
+		 LearnStart: m.learnStart,
+		  Learnings: m.learnings,
+	}
+	for cidr, ban := range m.bans {
+		snap.Bans = append(snap.Bans, snapshotEntry{Cidr: cidr, Expiry: ban.Expiry, Reason: ban.Reason})
+	}
+	for cidr, entry := range m.allows {
+		snap.Allows = append(snap.Allows, snapshotEntry{Cidr: cidr, Expiry: entry.Expiry, Reason: entry.Reason})
+	}
+
+	data, err := json.Marshal(snap)
+	m.mux.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Write then rename so that a crash leaves either the old or the new snapshot
+	if err := os.WriteFile(f.path + ".snapshot.tmp", data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(f.path + ".snapshot.tmp", f.path + ".snapshot"); err != nil {
+		return err
+	}
+
+	if f.log != nil {
+		if err := f.log.Close(); err != nil {
+			ErrorLog(err.Error())
+		}
+	}
+	log, err := os.OpenFile(f.path + ".log", os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	f.log = log
+	f.records = 0
+
+	DebugLog("snapshot written to %s.snapshot", f.path)
+	return nil
+}
+
+func (f *FileStore) Close() error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if err := f.snapshot(); err != nil {
+		return err
+	}
+	return f.log.Close()
+}
+
+func (f *FileStore) AddInfraction(ip net.IP, t time.Time, policy Policy, banable bool, ttl time.Duration) ([]time.Time, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	infractions, err := f.MemoryStore.AddInfraction(ip, t, policy, banable, ttl)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.append(logRecord{Op: "infraction", Ip: ip.String(), Time: t}); err != nil {
+		return nil, err
+	}
+
+	retained, err := f.MemoryStore.Infractions(ip)
+	if err != nil {
+		return nil, err
+	}
+	if n := len(infractions) - len(retained); n > 0 {
+		return infractions, f.append(logRecord{Op: "trim", Ip: ip.String(), N: n})
+	}
+	return infractions, nil
+}
+
+func (f *FileStore) TrimInfractions(ip net.IP, upto time.Time) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	before, err := f.MemoryStore.Infractions(ip)
+	if err != nil {
+		return err
+	}
+	if err := f.MemoryStore.TrimInfractions(ip, upto); err != nil {
+		return err
+	}
+	after, err := f.MemoryStore.Infractions(ip)
+	if err != nil {
+		return err
+	}
+
+	if trimmed := len(before) - len(after); trimmed > 0 {
+		return f.append(logRecord{Op: "trim", Ip: ip.String(), N: trimmed})
+	}
+	return nil
+}
+
+func (f *FileStore) UpdateScore(ip net.IP, fn func(score *Score) bool) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	var updated *Score
+	err := f.MemoryStore.UpdateScore(ip, func(score *Score) bool {
+		keep := fn(score)
+		if keep {
+			copied := *score
+			updated = &copied
+		}
+		return keep
+	})
+	if err != nil {
+		return err
+	}
+	return f.append(logRecord{Op: "score", Ip: ip.String(), Score: updated})
+}
+
+func (f *FileStore) UpdateTier(ip net.IP, fn func(tier *Tier) bool) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	var updated *Tier
+	err := f.MemoryStore.UpdateTier(ip, func(tier *Tier) bool {
+		keep := fn(tier)
+		if keep {
+			copied := *tier
+			updated = &copied
+		}
+		return keep
+	})
+	if err != nil {
+		return err
+	}
+	return f.append(logRecord{Op: "tier", Ip: ip.String(), Tier: updated})
+}
+
+func (f *FileStore) AddReport(key, reporter string, t time.Time, window time.Duration) ([]string, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	reporters, err := f.MemoryStore.AddReport(key, reporter, t, window)
+	if err != nil {
+		return nil, err
+	}
+	return reporters, f.append(logRecord{Op: "report", Key: key, Reporter: reporter, Time: t, N: int(window.Seconds())})
+}
+
+func (f *FileStore) Forget(ip net.IP) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if err := f.MemoryStore.Forget(ip); err != nil {
+		return err
+	}
+	return f.append(logRecord{Op: "forget", Ip: ip.String()})
+}
+
+func (f *FileStore) SetManualBan(ban ManualBan) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if err := f.MemoryStore.SetManualBan(ban); err != nil {
+		return err
+	}
+	return f.append(logRecord{Op: "ban", Cidr: ban.IpNet.String(), Expiry: ban.Expiry, Reason: ban.Reason})
+}
+
+func (f *FileStore) DelManualBan(ipnet *net.IPNet) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if err := f.MemoryStore.DelManualBan(ipnet); err != nil {
+		return err
+	}
+	return f.append(logRecord{Op: "unban", Cidr: ipnet.String()})
+}
+
+func (f *FileStore) SetAllow(entry TemporaryAllow) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if err := f.MemoryStore.SetAllow(entry); err != nil {
+		return err
+	}
+	return f.append(logRecord{Op: "allow", Cidr: entry.IpNet.String(), Expiry: entry.Expiry, Reason: entry.Reason})
+}
+
+func (f *FileStore) DelAllow(ipnet *net.IPNet) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if err := f.MemoryStore.DelAllow(ipnet); err != nil {
+		return err
+	}
+	return f.append(logRecord{Op: "disallow", Cidr: ipnet.String()})
+}
+
+func (f *FileStore) Schedule(key string, at time.Time) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if err := f.MemoryStore.Schedule(key, at); err != nil {
+		return err
+	}
+	return f.append(logRecord{Op: "schedule", Key: key, Time: at})
+}
+
+func (f *FileStore) Unschedule(key string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if err := f.MemoryStore.Unschedule(key); err != nil {
+		return err
+	}
+	return f.append(logRecord{Op: "unschedule", Key: key})
+}
+
+func (f *FileStore) Due(t time.Time) ([]string, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	keys, err := f.MemoryStore.Due(t)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		if err := f.append(logRecord{Op: "unschedule", Key: key}); err != nil {
+			return keys, err
+		}
+	}
+	return keys, nil
+}
+
+// Recent ban counts are deliberately not persisted, the rate windows are expected to be short
+func (f *FileStore) SetTripped(tripped bool) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if err := f.MemoryStore.SetTripped(tripped); err != nil {
+		return err
+	}
+	return f.append(logRecord{Op: "tripped", Flag: tripped})
+}
+
+func (f *FileStore) AddPending(ipnet *net.IPNet, t time.Time) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if err := f.MemoryStore.AddPending(ipnet, t); err != nil {
+		return err
+	}
+	return f.append(logRecord{Op: "pending", Cidr: ipnet.String(), Time: t})
+}
+
+func (f *FileStore) DelPending(ipnet *net.IPNet) (bool, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	pending, err := f.MemoryStore.DelPending(ipnet)
+	if err != nil || !pending {
+		return pending, err
+	}
+	return pending, f.append(logRecord{Op: "unpending", Cidr: ipnet.String()})
+}
+
+func (f *FileStore) LearningStart(t time.Time) (time.Time, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	start, err := f.MemoryStore.LearningStart(t)
+	if err != nil || !start.Equal(t) {
+		return start, err
+	}
+	return start, f.append(logRecord{Op: "learnstart", Time: t})
+}
+
+func (f *FileStore) RecordLearning(ip net.IP, t time.Time) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if err := f.MemoryStore.RecordLearning(ip, t); err != nil {
+		return err
+	}
+	return f.append(logRecord{Op: "learn", Ip: ip.String(), Time: t})
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const sweepPeriod = 1 * time.Minute // Of the keys counted or reported in memory
+
+// Persistence of the jail state, see Jail for the policy implemented on top.
+// Keys scheduled are either ips or manual bans (prefixed with manualBanPrefix).
+type InfractionStore interface {
+	// Count model, infractions are in chronological order.
+	// AddInfraction records an infraction returning it preceded by those previously retained, of which it then only
+	// retains the latest per retainInfractions. This is atomic so that exactly one of concurrent callers sees a ban start.
+	AddInfraction(ip net.IP, t time.Time, policy Policy, banable bool, ttl time.Duration) ([]time.Time, error)
+	Infractions(ip net.IP) ([]time.Time, error)
+	// Forget the infractions up to and including upto, ie unaffected by those concurrently recorded
+	TrimInfractions(ip net.IP, upto time.Time) error
+
+	// Score model, f returns false to delete the score instead.
+	// Note that f may be called multiple times should there be contention.
+	UpdateScore(ip net.IP, f func(score *Score) bool) error
+	// Escalation tiers, as for UpdateScore
+	UpdateTier(ip net.IP, f func(tier *Tier) bool) error
+
+	// Reporter quorum (see Policy), records a report of key (an ip or subnet) by reporter returning the distinct reporters within window
+	AddReport(key, reporter string, t time.Time, window time.Duration) ([]string, error)
+
+	// Forget the infractions, score and reports of an ip, its tier is instead deleted when unbanned
+	Forget(ip net.IP) error
+	// Tracked ips within ipnet, implementations may only support single address cidrs
+	IpsWithin(ipnet *net.IPNet) ([]net.IP, error)
+
+	SetManualBan(ban ManualBan) error
+	DelManualBan(ipnet *net.IPNet) error
+	ManualBans() ([]ManualBan, error)
+
+	SetAllow(entry TemporaryAllow) error
+	DelAllow(ipnet *net.IPNet) error
+	Allows() ([]TemporaryAllow, error)
+
+	Schedule(key string, at time.Time) error
+	Unschedule(key string) error
+	// Claim the keys due by t, each key is only claimed once
+	Due(t time.Time) ([]string, error)
+
+	// Sliding window counter, eg of bans for the circuit breaker (see Breaker) or of subnet infractions (see SubnetPolicy).
+	// Records an event under key returning the number recorded within window.
+	Count(key string, t time.Time, window time.Duration) (int, error)
+	SetTripped(tripped bool) error
+	Tripped() (bool, error)
+	// Bans held while the breaker is tripped, DelPending returns whether the ip or subnet was pending
+	AddPending(ipnet *net.IPNet, t time.Time) error
+	DelPending(ipnet *net.IPNet) (bool, error)
+	Pending() ([]PendingBan, error)
+
+	// Learning mode (see Learning), LearningStart returns when learning started having set it to t if not yet
+	LearningStart(t time.Time) (time.Time, error)
+	RecordLearning(ip net.IP, t time.Time) error
+	Learnings() (map[string]([]time.Time), error)
+
+	// Leader election amongst the processes sharing the store (see leaseDuration),
+	// Lead claims or renews the lease for id returning the current leader's id
+	Lead(id string, lease time.Duration) (string, error)
+	Resign(id string) error
+
+	// A page of at most about count ips' state (all if zero) from cursor (empty for the first page),
+	// returning the next cursor (empty once done). Pages may be short or, in service mode, repeat ips.
+	States(cursor string, count int) ([]IpState, string, error)
+
+	// Event stream shared amongst the processes sharing the store, retaining about the latest eventLimit events.
+	// Events awaits those after cursor (empty for those from now on) for up to wait, returning the next cursor.
+	Publish(event HookEvent) error
+	Events(cursor string, wait time.Duration) ([]HookEvent, string, error)
+
+	Close() error
+}
+
+type IpState struct {
+	Ip          net.IP
+	Infractions []time.Time
+	Score       *Score // Nil if not using the score model
+	Tier        *Tier  // Nil if not tiered
+}
+
+// Used in standalone mode
+type MemoryStore struct {
+	mux         sync.Mutex
+	                                        // net.IP is a slice type and cannot be used to map keys
+	infractions map[string]([]time.Time)    // Unix timestamps of infractions by offending ip
+	scores      map[string](*Score)         // Offending ip scores when using the score model
+	tiers       map[string]Tier             // Banned ip tiers when using escalation tiers
+	reports     map[string](map[string]time.Time) // Latest report by reporter by offending ip or subnet
+	bans        map[string]ManualBan        // Manual bans by cidr
+	events      []HookEvent                 // The latest eventLimit
+	eventSeq    uint64                      // Of the latest event
+	eventNotify chan struct{}               // Closed (and replaced) once an event is published
+	allows      map[string]TemporaryAllow   // Temporary allowlist entries by cidr
+	scheduler   *Scheduler
+
+	counts      map[string]([]time.Time)    // Recent events by counter key
+	expiries    map[string]time.Time        // When the counts or reports of a key fall out of their window
+	nextSweep   time.Time
+	tripped     bool
+	pending     map[string]time.Time        // Held bans by ip
+
+	learnStart  time.Time
+	learnings   map[string]([]time.Time)    // Infractions recorded while learning by ip
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		infractions: make(map[string]([]time.Time)),
+		     scores: make(map[string](*Score)),
+		      tiers: make(map[string]Tier),
+		    reports: make(map[string](map[string]time.Time)),
+		       bans: make(map[string]ManualBan),
+		     allows: make(map[string]TemporaryAllow),
+		  scheduler: NewScheduler(),
+		     counts: make(map[string]([]time.Time)),
+		   expiries: make(map[string]time.Time),
+		    pending: make(map[string]time.Time),
+		  learnings: make(map[string]([]time.Time)),
+		eventNotify: make(chan struct{}),
+	}
+}
+
+func (m *MemoryStore) AddInfraction(ip net.IP, t time.Time, policy Policy, banable bool, ttl time.Duration) ([]time.Time, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	s := ip.String()
+	previous := m.infractions[s]
+	recorded := append(append([]time.Time{}, previous...), t)
+
+	retained := recorded
+	if n := len(recorded) - retainInfractions(previous, policy, banable, t); n > 0 {
+		retained = recorded[n:]
+	}
+	m.retain(s, append([]time.Time{}, retained...))
+
+	return recorded, nil
+}
+
+func (m *MemoryStore) Infractions(ip net.IP) ([]time.Time, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	return append([]time.Time{}, m.infractions[ip.String()]...), nil
+}
+
+func (m *MemoryStore) TrimInfractions(ip net.IP, upto time.Time) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	s := ip.String()
+	n := 0
+	for n < len(m.infractions[s]) && !m.infractions[s][n].After(upto) {
+		n++
+	}
+	m.trim(s, n)
+
+	return nil
+}
+
+// Expects mux to be held, the reports of an ip are forgotten along with its last infractions
+func (m *MemoryStore) retain(s string, infractions []time.Time) {
+	if len(infractions) == 0 {
+		delete(m.infractions, s)
+		delete(m.reports, s)
+	} else {
+		m.infractions[s] = infractions
+	}
+}
+
+// Expects mux to be held
+func (m *MemoryStore) trim(s string, n int) {
+	if n >= len(m.infractions[s]) {
+		m.retain(s, nil)
+	} else {
+		m.retain(s, m.infractions[s][n:])
+	}
+}
+
+func (m *MemoryStore) UpdateScore(ip net.IP, f func(score *Score) bool) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	s := ip.String()
+
+	score := &Score{}
+	if existing, ok := m.scores[s]; ok {
+		*score = *existing
+	}
+
+	if f(score) {
+		m.scores[s] = score
+	} else {
+		delete(m.scores, s)
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) UpdateTier(ip net.IP, f func(tier *Tier) bool) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	s := ip.String()
+
+	tier := m.tiers[s]
+	if f(&tier) {
+		m.tiers[s] = tier
+	} else {
+		delete(m.tiers, s)
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) AddReport(key, reporter string, t time.Time, window time.Duration) ([]string, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.sweep(t)
+	if _, ok := m.reports[key]; !ok {
+		m.reports[key] = make(map[string]time.Time)
+	}
+	m.extend(key, t.Add(window))
+	if t.After(m.reports[key][reporter]) {
+		m.reports[key][reporter] = t
+	}
+
+	reporters := []string{}
+	for r, latest := range m.reports[key] {
+		if t.Sub(latest) >= window {
+			delete(m.reports[key], r)
+		} else {
+			reporters = append(reporters, r)
+		}
+	}
+	sort.Strings(reporters)
+
+	return reporters, nil
+}
+
+func (m *MemoryStore) Forget(ip net.IP) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	delete(m.infractions, ip.String())
+	delete(m.scores, ip.String())
+	delete(m.reports, ip.String())
+
+	return nil
+}
+
+func (m *MemoryStore) IpsWithin(ipnet *net.IPNet) ([]net.IP, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	matches := make(map[string]net.IP)
+	for s := range m.infractions {
+		if ip := net.ParseIP(s); ip != nil && ipnet.Contains(ip) {
+			matches[s] = ip
+		}
+	}
+	for s := range m.scores {
+		if ip := net.ParseIP(s); ip != nil && ipnet.Contains(ip) {
+			matches[s] = ip
+		}
+	}
+
+	ips := []net.IP{}
+	for _, ip := range matches {
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+func (m *MemoryStore) SetManualBan(ban ManualBan) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.bans[ban.IpNet.String()] = ban
+	return nil
+}
+
+func (m *MemoryStore) DelManualBan(ipnet *net.IPNet) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	delete(m.bans, ipnet.String())
+	return nil
+}
+
+func (m *MemoryStore) ManualBans() ([]ManualBan, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	bans := []ManualBan{}
+	for _, ban := range m.bans {
+		bans = append(bans, ban)
+	}
+	return bans, nil
+}
+
+func (m *MemoryStore) SetAllow(entry TemporaryAllow) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.allows[entry.IpNet.String()] = entry
+	return nil
+}
+
+func (m *MemoryStore) DelAllow(ipnet *net.IPNet) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	delete(m.allows, ipnet.String())
+	return nil
+}
+
+func (m *MemoryStore) Allows() ([]TemporaryAllow, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	entries := []TemporaryAllow{}
+	for _, entry := range m.allows {
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (m *MemoryStore) Schedule(key string, at time.Time) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.scheduler.Schedule(key, at)
+	return nil
+}
+
+func (m *MemoryStore) Unschedule(key string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.scheduler.Cancel(key)
+	return nil
+}
+
+func (m *MemoryStore) Due(t time.Time) ([]string, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	return m.scheduler.Due(t), nil
+}
+
+// Time the earliest key is due, zero if none
+func (m *MemoryStore) Next() time.Time {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	return m.scheduler.Next()
+}
+
+func (m *MemoryStore) Count(key string, t time.Time, window time.Duration) (int, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.sweep(t)
+	m.extend(key, t.Add(window))
+
+	times := append(m.counts[key], t)
+	for len(times) > 0 && t.Sub(times[0]) >= window {
+		times = times[1:]
+	}
+	m.counts[key] = times
+
+	return len(times), nil
+}
+
+// Expects mux to be held
+func (m *MemoryStore) extend(key string, expiry time.Time) {
+	if expiry.After(m.expiries[key]) {
+		m.expiries[key] = expiry
+	}
+}
+
+// Expects mux to be held, forgets the counts and reports of keys without any recent events (as expired keys in redis)
+func (m *MemoryStore) sweep(t time.Time) {
+	if t.Before(m.nextSweep) {
+		return
+	}
+	m.nextSweep = t.Add(sweepPeriod)
+
+	for key, expiry := range m.expiries {
+		if !t.Before(expiry) {
+			delete(m.counts, key)
+			delete(m.reports, key)
+			delete(m.expiries, key)
+		}
+	}
+}
+
+func (m *MemoryStore) SetTripped(tripped bool) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.tripped = tripped
+	return nil
+}
+
+func (m *MemoryStore) Tripped() (bool, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	return m.tripped, nil
+}
+
+func (m *MemoryStore) AddPending(ipnet *net.IPNet, t time.Time) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.pending[CidrString(ipnet)] = t
+	return nil
+}
+
+func (m *MemoryStore) DelPending(ipnet *net.IPNet) (bool, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	_, ok := m.pending[CidrString(ipnet)]
+	delete(m.pending, CidrString(ipnet))
+	return ok, nil
+}
+
+func (m *MemoryStore) Pending() ([]PendingBan, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	pending := []PendingBan{}
+	for s, t := range m.pending {
+		ipnet, err := ParseCidr(s)
+		if err != nil {
+			ErrorLog(err.Error())
+			continue
+		}
+		pending = append(pending, PendingBan{IpNet: ipnet, Held: t})
+	}
+	return pending, nil
+}
+
+func (m *MemoryStore) LearningStart(t time.Time) (time.Time, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if m.learnStart.IsZero() {
+		m.learnStart = t
+	}
+	return m.learnStart, nil
+}
+
+func (m *MemoryStore) RecordLearning(ip net.IP, t time.Time) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	s := ip.String()
+	m.learnings[s] = append(m.learnings[s], t)
+	if n := len(m.learnings[s]) - learnLimit; n > 0 {
+		m.learnings[s] = m.learnings[s][n:]
+	}
+	return nil
+}
+
+func (m *MemoryStore) Learnings() (map[string]([]time.Time), error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	learnings := make(map[string]([]time.Time))
+	for s, infractions := range m.learnings {
+		learnings[s] = append([]time.Time{}, infractions...)
+	}
+	return learnings, nil
+}
+
+// Pages are in ip string order, the cursor being the last ip of the previous page
+func (m *MemoryStore) States(cursor string, count int) ([]IpState, string, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	ips := []string{}
+	for s := range m.infractions {
+		ips = append(ips, s)
+	}
+	for s := range m.scores {
+		if _, ok := m.infractions[s]; !ok {
+			ips = append(ips, s)
+		}
+	}
+	sort.Strings(ips)
+
+	i := sort.SearchStrings(ips, cursor)
+	if i < len(ips) && ips[i] == cursor {
+		i++
+	}
+	ips = ips[i:]
+
+	next := ""
+	if count > 0 && len(ips) > count {
+		ips = ips[:count]
+		next = ips[count-1]
+	}
+
+	states := []IpState{}
+	for _, s := range ips {
+		state := IpState{Ip: net.ParseIP(s)}
+		if infractions, ok := m.infractions[s]; ok {
+			state.Infractions = append([]time.Time{}, infractions...)
+		}
+		if score, ok := m.scores[s]; ok {
+			copied := *score
+			state.Score = &copied
+		}
+		if t, ok := m.tiers[s]; ok {
+			state.Tier = &t
+		}
+		states = append(states, state)
+	}
+
+	return states, next, nil
+}
+
+func (m *MemoryStore) Publish(event HookEvent) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.events = append(m.events, event)
+	if n := len(m.events) - eventLimit; n > 0 {
+		m.events = m.events[n:]
+	}
+	m.eventSeq++
+
+	close(m.eventNotify)
+	m.eventNotify = make(chan struct{})
+	return nil
+}
+
+// The cursor is the sequence number of the latest event consumed
+func (m *MemoryStore) Events(cursor string, wait time.Duration) ([]HookEvent, string, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	seq := m.eventSeq
+	if cursor != "" {
+		var err error
+		if seq, err = strconv.ParseUint(cursor, 10, 64); err != nil {
+			return nil, "", fmt.Errorf("%q is not a valid cursor", cursor)
+		}
+	}
+
+	if m.eventSeq == seq {
+		notify := m.eventNotify
+		m.mux.Unlock()
+		select {
+			case <-notify:
+			case <-time.After(wait):
+		}
+		m.mux.Lock()
+	}
+
+	// Those no longer retained are skipped
+	n := m.eventSeq - seq
+	if n > uint64(len(m.events)) {
+		n = uint64(len(m.events))
+	}
+	events := append([]HookEvent{}, m.events[len(m.events)-int(n):]...)
+
+	return events, strconv.FormatUint(m.eventSeq, 10), nil
+}
+
+// Not shared hence always the leader
+func (m *MemoryStore) Lead(id string, lease time.Duration) (string, error) {
+	return id, nil
+}
+
+func (m *MemoryStore) Resign(id string) error {
+	return nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Subnets are counted under a distinct key from ips
+const subnetPrefix = "subnet "
+
+// Aggregate counting of infractions across a prefix, alongside the per ip counting, against addresses rotated through.
+// Once MaxRetry infractions from within the prefix arrive within FindTime the prefix is banned as a cidr for BanTime.
+type SubnetPolicy struct {
+	Ipv6     bool
+	Bits     int // Prefix length
+	MaxRetry int
+}
+
+// Parse comma separated subnet policies of the form v<4|6>/<bits>:<maxretry>, eg v4/24:30,v6/64:50
+func ParseSubnets(s string) ([]SubnetPolicy, error) {
+	subnets := []SubnetPolicy{}
+	if s == "" {
+		return subnets, nil
+	}
+
+	for _, t := range strings.Split(s, ",") {
+		invalid := fmt.Errorf("%q is not a valid subnet policy", t)
+
+		u := strings.SplitN(strings.TrimSpace(t), ":", 2)
+		if len(u) != 2 {
+			return nil, invalid
+		}
+		v := strings.SplitN(u[0], "/", 2)
+		if len(v) != 2 || (v[0] != "v4" && v[0] != "v6") {
+			return nil, invalid
+		}
+
+		subnet := SubnetPolicy{Ipv6: v[0] == "v6"}
+		max := 8 * net.IPv4len
+		if subnet.Ipv6 {
+			max = 8 * net.IPv6len
+		}
+
+		var err error
+		if subnet.Bits, err = strconv.Atoi(v[1]); err != nil || subnet.Bits <= 0 || subnet.Bits >= max {
+			return nil, invalid
+		}
+		if subnet.MaxRetry, err = strconv.Atoi(u[1]); err != nil || subnet.MaxRetry <= 0 {
+			return nil, invalid
+		}
+
+		subnets = append(subnets, subnet)
+	}
+
+	return subnets, nil
+}
+
+// The prefix containing ip, nil if ip is of the other address family
+func (s SubnetPolicy) Prefix(ip net.IP) *net.IPNet {
+	if (ip.To4() == nil) != s.Ipv6 {
+		return nil
+	}
+
+	ipnet := SingleCidr(ip)
+	_, bits := ipnet.Mask.Size()
+	ipnet.Mask = net.CIDRMask(s.Bits, bits)
+	ipnet.IP = ipnet.IP.Mask(ipnet.Mask)
+	return ipnet
+}
+
+func (s SubnetPolicy) String() string {
+	family := "v4"
+	if s.Ipv6 {
+		family = "v6"
+	}
+	return fmt.Sprintf("%s/%d:%d", family, s.Bits, s.MaxRetry)
+}